@@ -52,6 +52,7 @@
 //  - Error: azblob.StorageError
 //  - ListObject: azblob.BlobItem for objects, azblob.BlobPrefix for "directories"
 //  - ListOptions.BeforeList: *azblob.ListBlobsSegmentOptions
+//  - ReaderOptions.BeforeRead: *azblob.BlobAccessConditions
 //  - Reader: azblob.DownloadResponse
 //  - Attributes: azblob.BlobGetPropertiesResponse
 //  - WriterOptions.BeforeWrite: *azblob.UploadStreamToBlockBlobOptions
@@ -337,12 +338,38 @@ func (r *reader) As(i interface{}) bool {
 func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
 	blockBlobURL := b.blockBlobURL(key)
 
+	if offset < 0 {
+		// Azure doesn't support reading the last N bytes directly; compute the
+		// offset from the blob's size.
+		props, err := blockBlobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+		if err != nil {
+			return nil, err
+		}
+		offset += props.ContentLength()
+		if offset < 0 {
+			offset = 0
+		}
+	}
 	end := length
 	if end < 0 {
 		end = azblob.CountToEnd
 	}
 
-	blobDownloadResponse, err := blockBlobURL.Download(ctx, offset, end, azblob.BlobAccessConditions{}, false)
+	var ac azblob.BlobAccessConditions
+	if opts.BeforeRead != nil {
+		asFunc := func(i interface{}) bool {
+			p, ok := i.(**azblob.BlobAccessConditions)
+			if !ok {
+				return false
+			}
+			*p = &ac
+			return true
+		}
+		if err := opts.BeforeRead(asFunc); err != nil {
+			return nil, err
+		}
+	}
+	blobDownloadResponse, err := blockBlobURL.Download(ctx, offset, end, ac, false)
 	if err != nil {
 		return nil, err
 	}
@@ -431,6 +458,7 @@ func (b *bucket) Attributes(ctx context.Context, key string) (driver.Attributes,
 		ContentType:        blobPropertiesResponse.ContentType(),
 		Size:               blobPropertiesResponse.ContentLength(),
 		MD5:                blobPropertiesResponse.ContentMD5(),
+		ETag:               string(blobPropertiesResponse.ETag()),
 		ModTime:            blobPropertiesResponse.LastModified(),
 		Metadata:           blobPropertiesResponse.NewMetadata(),
 		AsFunc: func(i interface{}) bool {
@@ -536,14 +564,29 @@ func (b *bucket) SignedURL(ctx context.Context, key string, opts *driver.SignedU
 	}
 	blockBlobURL := b.blockBlobURL(key)
 	srcBlobParts := azblob.NewBlobURLParts(blockBlobURL.URL())
+	var perms azblob.BlobSASPermissions
+	switch opts.Method {
+	case http.MethodGet, http.MethodHead:
+		perms.Read = true
+	case http.MethodPut:
+		// SAS can't constrain the Content-Type of uploads, so
+		// opts.ContentType is not enforced.
+		perms.Create, perms.Write = true, true
+	case http.MethodDelete:
+		perms.Delete = true
+	default:
+		return "", fmt.Errorf("unsupported SignedURL method %q", opts.Method)
+	}
 
 	var err error
 	srcBlobParts.SAS, err = azblob.BlobSASSignatureValues{
-		Protocol:      azblob.SASProtocolHTTPS,
-		ExpiryTime:    time.Now().UTC().Add(opts.Expiry),
-		ContainerName: b.name,
-		BlobName:      srcBlobParts.BlobName,
-		Permissions:   azblob.BlobSASPermissions{Read: true}.String(),
+		Protocol:           azblob.SASProtocolHTTPS,
+		ExpiryTime:         time.Now().UTC().Add(opts.Expiry),
+		ContainerName:      b.name,
+		BlobName:           srcBlobParts.BlobName,
+		Permissions:        perms.String(),
+		ContentType:        opts.ResponseContentType,
+		ContentDisposition: opts.ResponseContentDisposition,
 	}.NewSASQueryParameters(b.opts.Credential)
 	if err != nil {
 		return "", err
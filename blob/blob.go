@@ -55,6 +55,8 @@
 package blob // import "gocloud.dev/blob"
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"context"
 	"crypto/md5"
@@ -67,6 +69,8 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -144,6 +148,8 @@ type Attributes struct {
 	// this package will always be lowercased). If there are duplicate
 	// case-insensitive keys (e.g., "foo" and "FOO"), only one value
 	// will be kept, and it is undefined which one.
+	// Because of the lowercasing, Metadata["User-Id"] never finds anything;
+	// use LookupMetadata to look up keys case-insensitively.
 	Metadata map[string]string
 	// ModTime is the time the blob was last modified.
 	ModTime time.Time
@@ -151,6 +157,31 @@ type Attributes struct {
 	Size int64
 	// MD5 is an MD5 hash of the blob contents or nil if not available.
 	MD5 []byte
+	// ETag is the provider's raw entity tag for the blob, or empty if not
+	// available. It changes whenever the blob is rewritten, but is not
+	// necessarily a hash of the blob contents; use MD5 for that.
+	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/ETag
+	ETag string
+	// StorageClass is the provider-specific storage class of the blob, such
+	// as "STANDARD_IA" for S3 or "NEARLINE" for GCS, or empty if the
+	// provider doesn't report one.
+	StorageClass string
+	// ServerSideEncryption is the provider-specific server-side encryption
+	// of the blob, such as "AES256" or "aws:kms" for S3, or empty if the
+	// provider doesn't report one.
+	ServerSideEncryption string
+	// VersionID identifies the version of the blob in a bucket that keeps
+	// multiple versions of each blob, such as an S3 bucket with versioning
+	// enabled. It is empty if the provider doesn't report one.
+	VersionID string
+	// RestoreOngoing is true while the blob is being restored from an
+	// archival storage class, such as S3's GLACIER. It is only reported by
+	// providers that have such storage classes.
+	RestoreOngoing bool
+	// RestoreExpiry is when the temporary copy of a blob restored from an
+	// archival storage class expires. It is the zero value if the blob has
+	// not been restored, or the restore is still ongoing.
+	RestoreExpiry time.Time
 
 	asFunc func(interface{}) bool
 }
@@ -164,6 +195,23 @@ func (a *Attributes) As(i interface{}) bool {
 	return a.asFunc(i)
 }
 
+// LookupMetadata returns the value of the metadata key matching key
+// case-insensitively, and whether it was found. For example, metadata
+// written with the key "User-Id" is found with LookupMetadata("User-Id").
+func (a *Attributes) LookupMetadata(key string) (string, bool) {
+	if v, ok := a.Metadata[strings.ToLower(key)]; ok {
+		return v, true
+	}
+	// Attributes may have been constructed by the caller with keys that are
+	// not lowercase.
+	for k, v := range a.Metadata {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
 // Writer writes bytes to a blob.
 //
 // It implements io.WriteCloser (https://golang.org/pkg/io/#Closer), and must be
@@ -182,11 +230,12 @@ type Writer struct {
 	// underlying driver.Writer. This step happens inside Write or Close and
 	// neither of them take a context.Context as an argument. The ctx is set
 	// to nil after we have passed it to NewTypedWriter.
-	ctx  context.Context
-	key  string
-	opts *driver.WriterOptions
-	buf  *bytes.Buffer
-	tctx context.Context // context for tracing only
+	ctx         context.Context
+	key         string
+	opts        *driver.WriterOptions
+	ctOverrides []ContentTypeOverride
+	buf         *bytes.Buffer
+	tctx        context.Context // context for tracing only
 }
 
 // sniffLen is the byte size of Writer.buf used to detect content-type.
@@ -260,6 +309,15 @@ func (w *Writer) Close() (err error) {
 // The error it returns is wrapped.
 func (w *Writer) open(p []byte) (int, error) {
 	ct := http.DetectContentType(p)
+	if len(w.ctOverrides) > 0 {
+		sniffed, _, _ := mime.ParseMediaType(ct)
+		for _, o := range w.ctOverrides {
+			if o.matches(w.key, sniffed) {
+				ct = o.ContentType
+				break
+			}
+		}
+	}
 	var err error
 	if w.w, err = w.b.NewTypedWriter(w.ctx, w.key, ct, w.opts); err != nil {
 		return 0, wrapError(w.b, err)
@@ -268,6 +326,7 @@ func (w *Writer) open(p []byte) (int, error) {
 	w.ctx = nil
 	w.key = ""
 	w.opts = nil
+	w.ctOverrides = nil
 	n, err := w.w.Write(p)
 	return n, wrapError(w.b, err)
 }
@@ -340,6 +399,18 @@ func (i *ListIterator) Next(ctx context.Context) (*ListObject, error) {
 	return i.Next(ctx)
 }
 
+// PageAs converts i to provider-specific types for the page of results that
+// contained the object most recently returned by Next, such as the raw
+// response of the provider's list request. After Next returns io.EOF, it
+// refers to the last page. It returns false before the first call to Next.
+// See Bucket.As for more details.
+func (i *ListIterator) PageAs(p interface{}) bool {
+	if i.page == nil || i.page.AsFunc == nil {
+		return false
+	}
+	return i.page.AsFunc(p)
+}
+
 // ListObject represents a single blob returned from List.
 type ListObject struct {
 	// Key is the key for this blob.
@@ -439,6 +510,226 @@ func (b *Bucket) ReadAll(ctx context.Context, key string) (_ []byte, err error)
 	return ioutil.ReadAll(r)
 }
 
+// NewMultiReader returns an io.ReadCloser that reads the blobs stored at keys
+// in order, as if they had been concatenated into a single blob. Each blob is
+// opened only after the previous one has been fully read, so a logical file
+// split across many blobs (e.g., as listed in a manifest) can be streamed
+// without first being concatenated.
+//
+// If a blob cannot be opened or read, the returned error names its key;
+// gcerrors.Code returns the code of the underlying error, e.g.
+// gcerrors.NotFound for a missing part.
+//
+// A nil ReaderOptions is treated the same as the zero value; it is used for
+// each of the underlying Readers.
+//
+// The caller must call Close on the returned io.ReadCloser when done reading.
+func (b *Bucket) NewMultiReader(ctx context.Context, keys []string, opts *ReaderOptions) io.ReadCloser {
+	return &multiReader{ctx: ctx, b: b, keys: keys, opts: opts}
+}
+
+// multiReader implements the io.ReadCloser returned by Bucket.NewMultiReader.
+type multiReader struct {
+	ctx  context.Context
+	b    *Bucket
+	keys []string // keys remaining to be opened
+	opts *ReaderOptions
+
+	r   *Reader // the Reader for key, or nil if none is open
+	key string
+	err error // sticky; returned by all subsequent calls to Read
+}
+
+func (r *multiReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		if r.r == nil {
+			if len(r.keys) == 0 {
+				r.err = io.EOF
+				break
+			}
+			r.key, r.keys = r.keys[0], r.keys[1:]
+			rr, err := r.b.NewReader(r.ctx, r.key, r.opts)
+			if err != nil {
+				r.err = multiReaderError(r.key, err)
+				break
+			}
+			r.r = rr
+		}
+		n, err := r.r.Read(p)
+		if err == io.EOF {
+			err = r.r.Close()
+			r.r = nil
+			if err != nil {
+				r.err = multiReaderError(r.key, err)
+			}
+			if n == 0 {
+				continue
+			}
+			return n, r.err
+		}
+		if err != nil {
+			r.err = multiReaderError(r.key, err)
+		}
+		return n, r.err
+	}
+	return 0, r.err
+}
+
+// Close implements io.Closer (https://golang.org/pkg/io/#Closer).
+func (r *multiReader) Close() error {
+	if r.err == nil {
+		r.err = errors.New("blob: read from closed multi-reader")
+	}
+	if r.r == nil {
+		return nil
+	}
+	err := r.r.Close()
+	r.r = nil
+	return err
+}
+
+// multiReaderError wraps err, which was returned while reading the blob at
+// key, preserving its error code.
+func multiReaderError(key string, err error) error {
+	code := gcerr.Unknown
+	if e, ok := err.(*gcerr.Error); ok {
+		code = e.Code
+	}
+	return gcerr.Newf(code, err, "blob: reading part %q", key)
+}
+
+// ArchiveFormat is the format of an archive written by
+// Bucket.ArchiveToWriter.
+type ArchiveFormat int
+
+const (
+	// ArchiveZip is a zip archive, with deflate-compressed entries.
+	ArchiveZip ArchiveFormat = iota
+	// ArchiveTar is an uncompressed tar archive.
+	ArchiveTar
+)
+
+// ArchiveOptions sets options for Bucket.ArchiveToWriter.
+type ArchiveOptions struct {
+	// SkipMissing, if true, makes ArchiveToWriter leave out blobs that don't
+	// exist, and report them as failures, instead of aborting the archive.
+	// Other errors always abort it.
+	SkipMissing bool
+
+	// FailureManifest, if not empty, is the name of an entry added at the
+	// end of the archive when blobs were left out because of SkipMissing.
+	// It lists the key and error of each of them, one per line.
+	FailureManifest string
+
+	// ReaderOptions is used to read each blob; it may be nil.
+	ReaderOptions *ReaderOptions
+}
+
+// ArchiveFailure describes a blob that was left out of an archive.
+type ArchiveFailure struct {
+	Key string
+	Err error
+}
+
+// ArchiveToWriter writes an archive in the given format to w, containing
+// an entry for each blob in keys, in order, named after its key. Each blob
+// is streamed into the archive as it is read, so the archive can be
+// written to, e.g., an http.ResponseWriter without buffering the blobs.
+//
+// A nil ArchiveOptions is treated the same as the zero value. If a blob
+// doesn't exist and opts.SkipMissing is true, it is left out of the archive
+// and included in the returned failures. Otherwise, ArchiveToWriter stops
+// at the first error and returns it; what has already been written to w is
+// then not a valid archive. Returned errors name the key of the blob that
+// caused them, and gcerrors.Code returns the code of the underlying error.
+func (b *Bucket) ArchiveToWriter(ctx context.Context, keys []string, w io.Writer, format ArchiveFormat, opts *ArchiveOptions) ([]ArchiveFailure, error) {
+	if opts == nil {
+		opts = &ArchiveOptions{}
+	}
+	var aw archiveWriter
+	switch format {
+	case ArchiveZip:
+		aw = zipArchiveWriter{zip.NewWriter(w)}
+	case ArchiveTar:
+		aw = tarArchiveWriter{tar.NewWriter(w)}
+	default:
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "blob: unsupported archive format %d", format)
+	}
+	var failures []ArchiveFailure
+	for _, key := range keys {
+		r, err := b.NewReader(ctx, key, opts.ReaderOptions)
+		if err != nil {
+			if e, ok := err.(*gcerr.Error); ok && e.Code == gcerr.NotFound && opts.SkipMissing {
+				failures = append(failures, ArchiveFailure{Key: key, Err: err})
+				continue
+			}
+			return failures, archiveError(key, err)
+		}
+		dst, err := aw.create(key, r.Size(), r.ModTime())
+		if err == nil {
+			_, err = io.Copy(dst, r)
+		}
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return failures, archiveError(key, err)
+		}
+	}
+	if len(failures) > 0 && opts.FailureManifest != "" {
+		var buf bytes.Buffer
+		for _, f := range failures {
+			fmt.Fprintf(&buf, "%s: %v\n", f.Key, f.Err)
+		}
+		dst, err := aw.create(opts.FailureManifest, int64(buf.Len()), time.Now())
+		if err == nil {
+			_, err = buf.WriteTo(dst)
+		}
+		if err != nil {
+			return failures, err
+		}
+	}
+	return failures, aw.Close()
+}
+
+// archiveWriter abstracts over the archive formats of
+// Bucket.ArchiveToWriter.
+type archiveWriter interface {
+	// create starts a new entry and returns a writer for its content,
+	// which must be exactly size bytes.
+	create(name string, size int64, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (w zipArchiveWriter) create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	return w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+}
+
+func (w tarArchiveWriter) create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}); err != nil {
+		return nil, err
+	}
+	return w.Writer, nil
+}
+
+// archiveError wraps err, which was returned while archiving the blob at
+// key, preserving its error code.
+func archiveError(key string, err error) error {
+	code := gcerr.Unknown
+	if e, ok := err.(*gcerr.Error); ok {
+		code = e.Code
+	}
+	return gcerr.Newf(code, err, "blob: archiving %q", key)
+}
+
 // List returns a ListIterator that can be used to iterate over blobs in a
 // bucket, in lexicographical order of UTF-8 encoded keys. The underlying
 // implementation fetches results in pages.
@@ -459,15 +750,284 @@ func (b *Bucket) List(opts *ListOptions) *ListIterator {
 	return &ListIterator{b: b.b, opts: dopts}
 }
 
+// ListN returns the first n blobs whose keys start with prefix, in
+// lexicographical order of UTF-8 encoded keys, or fewer if there aren't that
+// many. It pages through the listing as needed; since the provider may
+// return more results per page than requested, it may fetch slightly more
+// than n internally. It stops and returns ctx.Err() if ctx is done.
+func (b *Bucket) ListN(ctx context.Context, prefix string, n int) ([]*ListObject, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	iter := &ListIterator{b: b.b, opts: &driver.ListOptions{Prefix: prefix, PageSize: n}}
+	var objs []*ListObject
+	for len(objs) < n {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// ForEachObject calls fn for each blob whose key starts with prefix, in
+// lexicographical order of UTF-8 encoded keys, grouped by delimiter as in
+// ListOptions. Unlike collecting the results of List, it only holds one page
+// of the listing in memory at a time, so it can enumerate buckets of any
+// size. It stops and returns the error if fn returns one, and stops and
+// returns ctx.Err() if ctx is done.
+func (b *Bucket) ForEachObject(ctx context.Context, prefix, delimiter string, fn func(*ListObject) error) error {
+	iter := b.List(&ListOptions{Prefix: prefix, Delimiter: delimiter})
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+}
+
+// DefaultListPrefixesConcurrency is the default for
+// ListPrefixesOptions.MaxConcurrency.
+const DefaultListPrefixesConcurrency = 10
+
+// ListPrefixesOptions sets options for ListPrefixes.
+type ListPrefixesOptions struct {
+	// Delimiter is used as ListOptions.Delimiter when listing each prefix.
+	Delimiter string
+	// MaxConcurrency is the maximum number of prefixes listed at once.
+	// Defaults to DefaultListPrefixesConcurrency.
+	MaxConcurrency int
+	// Sort, if true, sorts the merged results by key. Otherwise they are
+	// grouped by prefix, in the order the prefixes were given.
+	Sort bool
+	// ForEach, if not nil, makes ListPrefixes stream the results instead of
+	// returning them: it is called with each blob, from a single goroutine,
+	// in the order they would otherwise be returned. While the blobs of one
+	// prefix are passed to ForEach, the following prefixes are listed
+	// ahead, each buffering up to about a page of blobs.
+	//
+	// With Sort, the prefixes are consumed in sorted order, which is only
+	// the order of their keys if none of them is a prefix of another, so
+	// overlapping prefixes fail with an error for which gcerrors.Code
+	// returns gcerrors.InvalidArgument.
+	//
+	// Listing stops at the first error, from listing a prefix or from
+	// ForEach, in the order the prefixes are consumed; errs maps that
+	// prefix to the error, and the prefixes after it are not reported.
+	ForEach func(*ListObject) error
+}
+
+// listPrefixesBuffer is the number of blobs listed ahead for each prefix
+// that ListPrefixesOptions.ForEach isn't being called for yet.
+const listPrefixesBuffer = 1000
+
+// ListPrefixes lists the blobs under each of prefixes concurrently and
+// returns the merged results. It is faster than listing the prefixes one
+// after another when they are independent, e.g. several top-level
+// "directories".
+//
+// Within each prefix, blobs are in lexicographical order of UTF-8 encoded
+// keys, as for List. How the prefixes are merged depends on
+// ListPrefixesOptions.Sort. Overlapping prefixes (e.g., "a/" and "a/b/")
+// produce duplicate results.
+//
+// Results are only returned for prefixes that were listed successfully; errs
+// maps each prefix that failed, if any, to its error. If ctx is canceled,
+// the prefixes not yet listed fail with ctx.Err().
+//
+// To process a large listing without holding it all in memory, set
+// ListPrefixesOptions.ForEach.
+//
+// A nil ListPrefixesOptions is treated the same as the zero value.
+func (b *Bucket) ListPrefixes(ctx context.Context, prefixes []string, opts *ListPrefixesOptions) (objs []*ListObject, errs map[string]error) {
+	if opts == nil {
+		opts = &ListPrefixesOptions{}
+	}
+	n := opts.MaxConcurrency
+	if n <= 0 {
+		n = DefaultListPrefixesConcurrency
+	}
+	if opts.ForEach != nil {
+		return nil, b.forEachPrefix(ctx, prefixes, n, opts)
+	}
+	results := make([][]*ListObject, len(prefixes))
+	resultErrs := make([]error, len(prefixes))
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, prefix := range prefixes {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			resultErrs[i] = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, prefix string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			iter := b.List(&ListOptions{Prefix: prefix, Delimiter: opts.Delimiter})
+			for {
+				obj, err := iter.Next(ctx)
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					resultErrs[i] = err
+					return
+				}
+				results[i] = append(results[i], obj)
+			}
+		}(i, prefix)
+	}
+	wg.Wait()
+
+	for i, prefix := range prefixes {
+		if resultErrs[i] != nil {
+			if errs == nil {
+				errs = map[string]error{}
+			}
+			errs[prefix] = resultErrs[i]
+			continue
+		}
+		objs = append(objs, results[i]...)
+	}
+	if opts.Sort {
+		sort.SliceStable(objs, func(i, j int) bool { return objs[i].Key < objs[j].Key })
+	}
+	return objs, errs
+}
+
+// forEachPrefix implements ListPrefixes with ListPrefixesOptions.ForEach,
+// listing at most n prefixes at once.
+func (b *Bucket) forEachPrefix(ctx context.Context, prefixes []string, n int, opts *ListPrefixesOptions) map[string]error {
+	if opts.Sort {
+		prefixes = append([]string(nil), prefixes...)
+		sort.Strings(prefixes)
+		for i := 1; i < len(prefixes); i++ {
+			// In sorted order, a prefix of another comes right before it,
+			// or before another prefix of it.
+			if strings.HasPrefix(prefixes[i], prefixes[i-1]) {
+				return map[string]error{prefixes[i]: gcerr.Newf(gcerr.InvalidArgument, nil, "blob.ListPrefixes: prefixes %q and %q overlap", prefixes[i-1], prefixes[i])}
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	// Prefixes are listed in order, each into its own channel, so that
+	// ForEach can be called with their blobs in order. The prefix being
+	// consumed always holds a slot, so the listing can't deadlock. Each
+	// error is set before its prefix's channel is closed.
+	results := make([]chan *ListObject, len(prefixes))
+	resultErrs := make([]error, len(prefixes))
+	for i := range prefixes {
+		results[i] = make(chan *ListObject, listPrefixesBuffer)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sem := make(chan struct{}, n)
+		for i, prefix := range prefixes {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				for j := i; j < len(prefixes); j++ {
+					resultErrs[j] = ctx.Err()
+					close(results[j])
+				}
+				return
+			}
+			wg.Add(1)
+			go func(i int, prefix string) {
+				defer func() {
+					close(results[i])
+					<-sem
+					wg.Done()
+				}()
+				iter := b.List(&ListOptions{Prefix: prefix, Delimiter: opts.Delimiter})
+				for {
+					obj, err := iter.Next(ctx)
+					if err == io.EOF {
+						return
+					}
+					if err != nil {
+						resultErrs[i] = err
+						return
+					}
+					select {
+					case results[i] <- obj:
+					case <-ctx.Done():
+						resultErrs[i] = ctx.Err()
+						return
+					}
+				}
+			}(i, prefix)
+		}
+	}()
+
+	for i, prefix := range prefixes {
+		for obj := range results[i] {
+			if err := opts.ForEach(obj); err != nil {
+				return map[string]error{prefix: err}
+			}
+		}
+		if err := resultErrs[i]; err != nil {
+			return map[string]error{prefix: err}
+		}
+	}
+	return nil
+}
+
 // Attributes returns attributes for the blob stored at key.
 //
 // If the blob does not exist, Attributes returns an error for which
 // gcerrors.Code will return gcerrors.NotFound.
-func (b *Bucket) Attributes(ctx context.Context, key string) (_ Attributes, err error) {
+func (b *Bucket) Attributes(ctx context.Context, key string) (Attributes, error) {
+	return b.AttributesWithOptions(ctx, key, nil)
+}
+
+// AttributesWithOptions is like Attributes, with opts.
+// A nil AttributesOptions is treated the same as the zero value.
+func (b *Bucket) AttributesWithOptions(ctx context.Context, key string, opts *AttributesOptions) (_ Attributes, err error) {
 	ctx = trace.StartSpan(ctx, "gocloud.dev/blob.Attributes")
 	defer func() { trace.EndSpan(ctx, err) }()
 
-	a, err := b.b.Attributes(ctx, key)
+	if opts == nil {
+		opts = &AttributesOptions{}
+	}
+	var a driver.Attributes
+	if g, ok := b.b.(driver.AttributeGetter); ok {
+		a, err = g.AttributesWithOptions(ctx, key, &driver.AttributesOptions{BeforeAttributes: opts.BeforeAttributes})
+	} else {
+		if opts.BeforeAttributes != nil {
+			// The provider has no types to expose.
+			if err := opts.BeforeAttributes(func(interface{}) bool { return false }); err != nil {
+				return Attributes{}, err
+			}
+		}
+		a, err = b.b.Attributes(ctx, key)
+	}
 	if err != nil {
 		return Attributes{}, wrapError(b.b, err)
 	}
@@ -482,19 +1042,46 @@ func (b *Bucket) Attributes(ctx context.Context, key string) (_ Attributes, err
 		}
 	}
 	return Attributes{
-		CacheControl:       a.CacheControl,
-		ContentDisposition: a.ContentDisposition,
-		ContentEncoding:    a.ContentEncoding,
-		ContentLanguage:    a.ContentLanguage,
-		ContentType:        a.ContentType,
-		Metadata:           md,
-		ModTime:            a.ModTime,
-		Size:               a.Size,
-		MD5:                a.MD5,
-		asFunc:             a.AsFunc,
+		CacheControl:         a.CacheControl,
+		ContentDisposition:   a.ContentDisposition,
+		ContentEncoding:      a.ContentEncoding,
+		ContentLanguage:      a.ContentLanguage,
+		ContentType:          a.ContentType,
+		Metadata:             md,
+		ModTime:              a.ModTime,
+		Size:                 a.Size,
+		MD5:                  a.MD5,
+		ETag:                 a.ETag,
+		StorageClass:         a.StorageClass,
+		ServerSideEncryption: a.ServerSideEncryption,
+		VersionID:            a.VersionID,
+		RestoreOngoing:       a.RestoreOngoing,
+		RestoreExpiry:        a.RestoreExpiry,
+		asFunc:               a.AsFunc,
 	}, nil
 }
 
+// Exists reports whether a blob is stored at key. It returns false and a nil
+// error if the blob does not exist, and an error only if existence could not
+// be determined, e.g. because of missing permissions.
+func (b *Bucket) Exists(ctx context.Context, key string) (_ bool, err error) {
+	ctx = trace.StartSpan(ctx, "gocloud.dev/blob.Exists")
+	defer func() { trace.EndSpan(ctx, err) }()
+
+	if c, ok := b.b.(driver.ExistenceChecker); ok {
+		exists, err := c.Exists(ctx, key)
+		return exists, wrapError(b.b, err)
+	}
+	_, err = b.b.Attributes(ctx, key)
+	if err != nil {
+		if b.b.ErrorCode(err) == gcerr.NotFound {
+			return false, nil
+		}
+		return false, wrapError(b.b, err)
+	}
+	return true, nil
+}
+
 // NewReader is a shortcut for NewRangedReader with offset=0 and length=-1.
 func (b *Bucket) NewReader(ctx context.Context, key string, opts *ReaderOptions) (*Reader, error) {
 	return b.NewRangeReader(ctx, key, 0, -1, opts)
@@ -504,6 +1091,11 @@ func (b *Bucket) NewReader(ctx context.Context, key string, opts *ReaderOptions)
 // It reads at most length bytes starting at offset (>= 0).
 // If length is negative, it will read till the end of the blob.
 //
+// A negative offset reads the last -offset bytes of the blob (or all of it, if
+// it is shorter), e.g. to read a trailer; length must then be negative.
+// Reader.Size still reports the size of the entire blob. Some providers need
+// an extra request to support this.
+//
 // If the blob does not exist, NewRangeReader returns an error for which
 // gcerrors.Code will return gcerrors.NotFound. Attributes is a lighter-weight way to
 // check for existence.
@@ -512,13 +1104,15 @@ func (b *Bucket) NewReader(ctx context.Context, key string, opts *ReaderOptions)
 //
 // The caller must call Close on the returned Reader when done reading.
 func (b *Bucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *ReaderOptions) (_ *Reader, err error) {
-	if offset < 0 {
-		return nil, errors.New("blob.NewRangeReader: offset must be non-negative")
+	if offset < 0 && length >= 0 {
+		return nil, errors.New("blob.NewRangeReader: length must be negative when offset is negative")
 	}
 	if opts == nil {
 		opts = &ReaderOptions{}
 	}
-	dopts := &driver.ReaderOptions{}
+	dopts := &driver.ReaderOptions{
+		BeforeRead: opts.BeforeRead,
+	}
 	tctx := trace.StartSpan(ctx, "gocloud.dev/blob.NewRangeReader")
 	defer func() {
 		if err != nil {
@@ -532,6 +1126,437 @@ func (b *Bucket) NewRangeReader(ctx context.Context, key string, offset, length
 	return &Reader{b: b.b, r: r, tctx: tctx}, nil
 }
 
+// ResilientReaderOptions sets options for Bucket.NewResilientReader.
+type ResilientReaderOptions struct {
+	// MaxRetries is the number of times a read may be resumed after an
+	// error, over the lifetime of the reader. If 0, 3 is used; if negative,
+	// reads are not resumed.
+	MaxRetries int
+
+	// ReaderOptions is used to open the blob each time; it may be nil.
+	ReaderOptions *ReaderOptions
+}
+
+// defaultResilientReaderRetries is the default for
+// ResilientReaderOptions.MaxRetries.
+const defaultResilientReaderRetries = 3
+
+// NewResilientReader returns a ResilientReader for the blob stored at key.
+// If reading the content fails, for example because the connection was
+// reset during a long download, the ResilientReader transparently reopens
+// the blob from the offset it had reached and continues reading, up to
+// opts.MaxRetries times. It doesn't resume after ctx is done, or if the
+// blob cannot be reopened because it no longer exists, access is denied,
+// or its size has changed, since reading on would then return
+// inconsistent content.
+//
+// The blob is opened before NewResilientReader returns, so an error for a
+// missing blob (gcerrors.NotFound) is returned directly. A nil
+// ResilientReaderOptions is treated the same as the zero value.
+//
+// The caller must call Close on the returned ResilientReader when done
+// reading.
+func (b *Bucket) NewResilientReader(ctx context.Context, key string, opts *ResilientReaderOptions) (*ResilientReader, error) {
+	if opts == nil {
+		opts = &ResilientReaderOptions{}
+	}
+	retries := opts.MaxRetries
+	if retries == 0 {
+		retries = defaultResilientReaderRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	r, err := b.NewReader(ctx, key, opts.ReaderOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &ResilientReader{
+		ctx:        ctx,
+		b:          b,
+		key:        key,
+		opts:       opts.ReaderOptions,
+		maxRetries: retries,
+		r:          r,
+		size:       r.Size(),
+	}, nil
+}
+
+// ResilientReader reads a blob, resuming after errors. It is returned by
+// Bucket.NewResilientReader.
+type ResilientReader struct {
+	ctx        context.Context
+	b          *Bucket
+	key        string
+	opts       *ReaderOptions
+	maxRetries int
+
+	r       *Reader // nil if the blob must be reopened
+	size    int64   // size of the blob when it was first opened
+	offset  int64   // bytes read so far
+	retries int
+	err     error // sticky; returned by all subsequent calls to Read
+}
+
+// Read implements io.Reader (https://golang.org/pkg/io/#Reader).
+func (r *ResilientReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		if r.r == nil {
+			rr, err := r.reopen()
+			if err != nil {
+				r.fail(err)
+				continue
+			}
+			r.r = rr
+		}
+		n, err := r.r.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		_ = r.r.Close()
+		r.r = nil
+		r.fail(err)
+		if n > 0 {
+			// Return what was read; the next Read resumes or returns r.err.
+			return n, nil
+		}
+	}
+	return 0, r.err
+}
+
+// reopen opens the blob from r.offset.
+func (r *ResilientReader) reopen() (*Reader, error) {
+	rr, err := r.b.NewRangeReader(r.ctx, r.key, r.offset, -1, r.opts)
+	if err != nil {
+		return nil, err
+	}
+	if rr.Size() != r.size {
+		_ = rr.Close()
+		return nil, gcerr.Newf(gcerr.FailedPrecondition, nil, "blob: size of %q changed from %d to %d while reading it", r.key, r.size, rr.Size())
+	}
+	return rr, nil
+}
+
+// fail handles err, returned while reading or reopening the blob: it uses
+// up a retry if reading can be resumed, and otherwise sets r.err.
+func (r *ResilientReader) fail(err error) {
+	code := gcerr.Unknown
+	if e, ok := err.(*gcerr.Error); ok {
+		code = e.Code
+	}
+	switch {
+	case code == gcerr.NotFound, code == gcerr.PermissionDenied, code == gcerr.FailedPrecondition, r.ctx.Err() != nil:
+		r.err = err
+	case r.retries >= r.maxRetries:
+		r.err = gcerr.Newf(code, err, "blob: reading %q failed after %d retries", r.key, r.retries)
+	default:
+		r.retries++
+	}
+}
+
+// BytesRead returns the number of bytes read so far.
+func (r *ResilientReader) BytesRead() int64 {
+	return r.offset
+}
+
+// Retries returns the number of retries used so far, including a failed
+// attempt to resume.
+func (r *ResilientReader) Retries() int {
+	return r.retries
+}
+
+// Close implements io.Closer (https://golang.org/pkg/io/#Closer).
+func (r *ResilientReader) Close() error {
+	if r.err == nil {
+		r.err = errors.New("blob: read from closed resilient reader")
+	}
+	if r.r == nil {
+		return nil
+	}
+	err := r.r.Close()
+	r.r = nil
+	return err
+}
+
+// PrefetchReaderOptions sets options for Bucket.NewPrefetchReader.
+type PrefetchReaderOptions struct {
+	// ChunkSize is the size in bytes of each range read. If 0, 8 MiB is
+	// used.
+	ChunkSize int64
+
+	// Concurrency is the number of chunks read ahead of the read cursor
+	// concurrently. If 0, 4 is used.
+	Concurrency int
+
+	// ReaderOptions is used for each range read; it may be nil.
+	ReaderOptions *ReaderOptions
+}
+
+const (
+	defaultPrefetchChunkSize   = 8 << 20
+	defaultPrefetchConcurrency = 4
+)
+
+// NewPrefetchReader returns a PrefetchReader for the blob stored at key,
+// which reads it sequentially by issuing range reads of opts.ChunkSize
+// bytes for up to opts.Concurrency chunks ahead of the read cursor, and
+// returning them in order. For large sequential scans over high-latency
+// links, this has much higher throughput than a single Reader. At most
+// opts.Concurrency+1 chunks are held in memory.
+//
+// The first chunk is read before NewPrefetchReader returns, so an error for
+// a missing blob (gcerrors.NotFound) is returned directly. If the size of
+// the blob changes while it is being read, reading fails with an error for
+// which gcerrors.Code returns gcerrors.FailedPrecondition. A nil
+// PrefetchReaderOptions is treated the same as the zero value.
+//
+// The caller must call Close on the returned PrefetchReader when done
+// reading.
+func (b *Bucket) NewPrefetchReader(ctx context.Context, key string, opts *PrefetchReaderOptions) (*PrefetchReader, error) {
+	if opts == nil {
+		opts = &PrefetchReaderOptions{}
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultPrefetchChunkSize
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultPrefetchConcurrency
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &PrefetchReader{
+		ctx:         ctx,
+		cancel:      cancel,
+		b:           b,
+		key:         key,
+		opts:        opts.ReaderOptions,
+		chunkSize:   chunkSize,
+		concurrency: concurrency,
+		size:        -1,
+	}
+	first := &prefetchChunk{done: make(chan struct{})}
+	r.fetch(first, 0)
+	if first.err != nil {
+		cancel()
+		return nil, first.err
+	}
+	r.cur = first.data
+	r.next = chunkSize
+	r.fill()
+	return r, nil
+}
+
+// PrefetchReader reads a blob sequentially, prefetching chunks of it
+// concurrently. It is returned by Bucket.NewPrefetchReader.
+type PrefetchReader struct {
+	ctx         context.Context
+	cancel      func()
+	b           *Bucket
+	key         string
+	opts        *ReaderOptions
+	chunkSize   int64
+	concurrency int
+
+	size    int64            // size of the blob, from the first chunk
+	cur     []byte           // unread part of the current chunk
+	next    int64            // offset of the next chunk to fetch
+	pending []*prefetchChunk // chunks being fetched, in order
+	err     error            // sticky; returned by all subsequent calls to Read
+}
+
+// prefetchChunk is a chunk of a blob read by a PrefetchReader.
+type prefetchChunk struct {
+	done chan struct{} // closed when data or err is set
+	data []byte
+	err  error
+}
+
+// fetch reads the chunk of the blob at offset into c. The first call, for
+// offset 0, also sets r.size.
+func (r *PrefetchReader) fetch(c *prefetchChunk, offset int64) {
+	defer close(c.done)
+	rr, err := r.b.NewRangeReader(r.ctx, r.key, offset, r.chunkSize, r.opts)
+	if err != nil {
+		c.err = err
+		return
+	}
+	defer rr.Close()
+	if r.size < 0 {
+		r.size = rr.Size()
+	} else if rr.Size() != r.size {
+		c.err = gcerr.Newf(gcerr.FailedPrecondition, nil, "blob: size of %q changed from %d to %d while reading it", r.key, r.size, rr.Size())
+		return
+	}
+	if c.data, c.err = ioutil.ReadAll(rr); c.err != nil {
+		return
+	}
+	want := r.size - offset
+	if want > r.chunkSize {
+		want = r.chunkSize
+	}
+	if int64(len(c.data)) != want {
+		c.err = gcerr.Newf(gcerr.Unknown, io.ErrUnexpectedEOF, "blob: read %d bytes of %q at offset %d, want %d", len(c.data), r.key, offset, want)
+	}
+}
+
+// fill starts fetching chunks until r.concurrency are pending or the end
+// of the blob is reached.
+func (r *PrefetchReader) fill() {
+	for len(r.pending) < r.concurrency && r.next < r.size {
+		c := &prefetchChunk{done: make(chan struct{})}
+		go r.fetch(c, r.next)
+		r.pending = append(r.pending, c)
+		r.next += r.chunkSize
+	}
+}
+
+// Read implements io.Reader (https://golang.org/pkg/io/#Reader).
+func (r *PrefetchReader) Read(p []byte) (int, error) {
+	for r.err == nil && len(r.cur) == 0 {
+		if len(r.pending) == 0 {
+			r.err = io.EOF
+			break
+		}
+		c := r.pending[0]
+		r.pending = r.pending[1:]
+		<-c.done
+		if c.err != nil {
+			r.err = c.err
+			break
+		}
+		r.cur = c.data
+		r.fill()
+	}
+	if len(r.cur) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Size returns the size of the blob content in bytes.
+func (r *PrefetchReader) Size() int64 {
+	return r.size
+}
+
+// Close implements io.Closer (https://golang.org/pkg/io/#Closer). It stops
+// any chunk reads that are in progress.
+func (r *PrefetchReader) Close() error {
+	r.cancel()
+	for _, c := range r.pending {
+		<-c.done
+	}
+	r.pending = nil
+	r.cur = nil
+	if r.err == nil {
+		r.err = errors.New("blob: read from closed prefetch reader")
+	}
+	return nil
+}
+
+// ByteRange is a range of the content of a blob, for Bucket.ReadRanges.
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// ReadRangesOptions sets options for Bucket.ReadRanges.
+type ReadRangesOptions struct {
+	// MaxGap is the largest number of unrequested bytes between two ranges
+	// for which they are read together with a single range read, discarding
+	// the bytes in between. If 0, 64 KiB is used; if negative, only ranges
+	// that overlap or are adjacent are read together.
+	MaxGap int64
+
+	// ReaderOptions is used for each range read; it may be nil.
+	ReaderOptions *ReaderOptions
+}
+
+// defaultMaxRangeGap is the default for ReadRangesOptions.MaxGap.
+const defaultMaxRangeGap = 64 << 10
+
+// ReadRanges reads the given ranges of the blob stored at key, and returns
+// their contents in the same order as ranges. Ranges that are close to each
+// other (see ReadRangesOptions.MaxGap) are coalesced into a single range
+// read, so that formats like Parquet that read many small, scattered ranges
+// need far fewer round trips than with a NewRangeReader call per range.
+// Ranges may be given in any order and may overlap.
+//
+// As with NewRangeReader, a range that extends past the end of the blob
+// returns the bytes up to the end. The returned slices may share memory, so
+// they must not be appended to or modified. A nil ReadRangesOptions is
+// treated the same as the zero value.
+func (b *Bucket) ReadRanges(ctx context.Context, key string, ranges []ByteRange, opts *ReadRangesOptions) ([][]byte, error) {
+	if opts == nil {
+		opts = &ReadRangesOptions{}
+	}
+	maxGap := opts.MaxGap
+	if maxGap == 0 {
+		maxGap = defaultMaxRangeGap
+	} else if maxGap < 0 {
+		maxGap = 0
+	}
+	for i, r := range ranges {
+		if r.Offset < 0 || r.Length < 0 {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "blob.ReadRanges: range %d has a negative offset or length", i)
+		}
+	}
+	// Visit the ranges in offset order, reading each run of ranges that are
+	// at most maxGap apart with a single range read.
+	order := make([]int, len(ranges))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return ranges[order[i]].Offset < ranges[order[j]].Offset })
+	out := make([][]byte, len(ranges))
+	for len(order) > 0 {
+		start := ranges[order[0]].Offset
+		end := start + ranges[order[0]].Length
+		n := 1
+		for ; n < len(order); n++ {
+			r := ranges[order[n]]
+			if r.Offset > end+maxGap {
+				break
+			}
+			if e := r.Offset + r.Length; e > end {
+				end = e
+			}
+		}
+		var data []byte
+		if end > start {
+			var err error
+			if data, err = b.readRange(ctx, key, start, end-start, opts.ReaderOptions); err != nil {
+				return nil, err
+			}
+		}
+		for _, i := range order[:n] {
+			lo := ranges[i].Offset - start
+			if lo > int64(len(data)) {
+				lo = int64(len(data))
+			}
+			hi := lo + ranges[i].Length
+			if hi > int64(len(data)) {
+				hi = int64(len(data))
+			}
+			out[i] = data[lo:hi:hi]
+		}
+		order = order[n:]
+	}
+	return out, nil
+}
+
+// readRange returns the content of a range of the blob stored at key.
+func (b *Bucket) readRange(ctx context.Context, key string, offset, length int64, opts *ReaderOptions) ([]byte, error) {
+	r, err := b.NewRangeReader(ctx, key, offset, length, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
 // WriteAll is a shortcut for creating a Writer via NewWriter and writing p.
 func (b *Bucket) WriteAll(ctx context.Context, key string, p []byte, opts *WriterOptions) (err error) {
 	w, err := b.NewWriter(ctx, key, opts)
@@ -545,6 +1570,18 @@ func (b *Bucket) WriteAll(ctx context.Context, key string, p []byte, opts *Write
 	return w.Close()
 }
 
+// lowercaseMetadata returns md with lowercase keys. Providers are
+// inconsistent, but at least some treat keys as case-insensitive. To make
+// the behavior consistent, we force-lowercase them when writing and reading.
+// prefix identifies the caller and field in errors.
+func lowercaseMetadata(prefix string, md map[string]string) (map[string]string, error) {
+	lower, err := driver.LowercaseMetadata(md)
+	if err != nil {
+		return nil, fmt.Errorf("%s.Metadata: %v", prefix, err)
+	}
+	return lower, nil
+}
+
 // NewWriter returns a Writer that writes to the blob stored at key.
 // A nil WriterOptions is treated the same as the zero value.
 //
@@ -576,22 +1613,24 @@ func (b *Bucket) NewWriter(ctx context.Context, key string, opts *WriterOptions)
 		BeforeWrite:        opts.BeforeWrite,
 	}
 	if len(opts.Metadata) > 0 {
-		// Providers are inconsistent, but at least some treat keys
-		// as case-insensitive. To make the behavior consistent, we
-		// force-lowercase them when writing and reading.
-		md := make(map[string]string, len(opts.Metadata))
-		for k, v := range opts.Metadata {
-			if k == "" {
-				return nil, errors.New("blob.NewWriter: WriterOptions.Metadata keys may not be empty strings")
-			}
-			lowerK := strings.ToLower(k)
-			if _, found := md[lowerK]; found {
-				return nil, fmt.Errorf("blob.NewWriter: duplicate case-insensitive metadata key %q", lowerK)
-			}
-			md[lowerK] = v
+		md, err := lowercaseMetadata("blob.NewWriter: WriterOptions", opts.Metadata)
+		if err != nil {
+			return nil, err
 		}
 		dopts.Metadata = md
 	}
+	var overrides []ContentTypeOverride
+	if opts.ContentType == "" && len(opts.ContentTypeOverrides) > 0 {
+		overrides = make([]ContentTypeOverride, len(opts.ContentTypeOverrides))
+		for i, o := range opts.ContentTypeOverrides {
+			t, p, err := mime.ParseMediaType(o.ContentType)
+			if err != nil {
+				return nil, fmt.Errorf("blob.NewWriter: invalid WriterOptions.ContentTypeOverrides[%d].ContentType: %v", i, err)
+			}
+			o.ContentType = mime.FormatMediaType(t, p)
+			overrides[i] = o
+		}
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	tctx := trace.StartSpan(ctx, "gocloud.dev/blob.NewWriter")
 	defer func() {
@@ -622,15 +1661,16 @@ func (b *Bucket) NewWriter(ctx context.Context, key string, opts *WriterOptions)
 		}, nil
 	}
 	return &Writer{
-		ctx:        ctx,
-		cancel:     cancel,
-		b:          b.b,
-		key:        key,
-		opts:       dopts,
-		buf:        bytes.NewBuffer([]byte{}),
-		contentMD5: opts.ContentMD5,
-		md5hash:    md5.New(),
-		tctx:       tctx,
+		ctx:         ctx,
+		cancel:      cancel,
+		b:           b.b,
+		key:         key,
+		opts:        dopts,
+		ctOverrides: overrides,
+		buf:         bytes.NewBuffer([]byte{}),
+		contentMD5:  opts.ContentMD5,
+		md5hash:     md5.New(),
+		tctx:        tctx,
 	}, nil
 }
 
@@ -644,8 +1684,154 @@ func (b *Bucket) Delete(ctx context.Context, key string) (err error) {
 	return wrapError(b.b, b.b.Delete(ctx, key))
 }
 
-// SignedURL returns a URL that can be used to GET the blob for the duration
-// specified in opts.Expiry.
+// DeleteAll deletes the blobs stored at keys, using batch requests if the
+// provider supports them (e.g., S3's DeleteObjects, with up to 1000 keys per
+// request), and otherwise deleting them one at a time. Unlike Delete, it
+// doesn't report keys that don't exist as errors.
+//
+// If some blobs could not be deleted, DeleteAll returns a *DeleteAllError
+// holding the error for each of their keys; the other blobs are deleted.
+func (b *Bucket) DeleteAll(ctx context.Context, keys []string) (err error) {
+	ctx = trace.StartSpan(ctx, "gocloud.dev/blob.DeleteAll")
+	defer func() { trace.EndSpan(ctx, err) }()
+
+	var errs map[string]error
+	if bd, ok := b.b.(driver.BatchDeleter); ok {
+		errs = bd.DeleteAll(ctx, keys)
+	} else {
+		for _, key := range keys {
+			if err := b.b.Delete(ctx, key); err != nil && b.b.ErrorCode(err) != gcerr.NotFound {
+				if errs == nil {
+					errs = map[string]error{}
+				}
+				errs[key] = err
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	for key, err := range errs {
+		errs[key] = wrapError(b.b, err)
+	}
+	return &DeleteAllError{Errors: errs}
+}
+
+// DeleteAllError is returned by Bucket.DeleteAll when some blobs could not be
+// deleted.
+type DeleteAllError struct {
+	// Errors maps the keys of the blobs that could not be deleted to the
+	// reasons. gcerrors.Code can be used on each of them.
+	Errors map[string]error
+}
+
+func (e *DeleteAllError) Error() string {
+	keys := make([]string, 0, len(e.Errors))
+	for key := range e.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	const maxShown = 3
+	var msgs []string
+	for i, key := range keys {
+		if i == maxShown {
+			msgs = append(msgs, fmt.Sprintf("and %d more", len(keys)-maxShown))
+			break
+		}
+		msgs = append(msgs, fmt.Sprintf("%q: %v", key, e.Errors[key]))
+	}
+	return fmt.Sprintf("blob: failed to delete %d blobs: %s", len(keys), strings.Join(msgs, "; "))
+}
+
+// Copy copies the blob stored at srcKey to dstKey, replacing any blob
+// stored at dstKey. Providers that support it copy the blob without
+// downloading it (e.g., S3's CopyObject, or a multipart copy for blobs over
+// 5 GB); for others, Copy reads the blob and writes it back.
+//
+// The copy keeps the content type, metadata and other attributes of the
+// source blob, unless they are overridden in opts. A nil CopyOptions is
+// treated the same as the zero value.
+//
+// If the source blob does not exist, Copy returns an error for which
+// gcerrors.Code will return gcerrors.NotFound.
+func (b *Bucket) Copy(ctx context.Context, dstKey, srcKey string, opts *CopyOptions) (err error) {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	dopts := &driver.CopyOptions{
+		ContentType: opts.ContentType,
+		BeforeCopy:  opts.BeforeCopy,
+	}
+	if opts.ContentType != "" {
+		t, p, err := mime.ParseMediaType(opts.ContentType)
+		if err != nil {
+			return err
+		}
+		dopts.ContentType = mime.FormatMediaType(t, p)
+	}
+	if opts.Metadata != nil {
+		if dopts.Metadata, err = lowercaseMetadata("blob.Copy: CopyOptions", opts.Metadata); err != nil {
+			return err
+		}
+	}
+	ctx = trace.StartSpan(ctx, "gocloud.dev/blob.Copy")
+	defer func() { trace.EndSpan(ctx, err) }()
+
+	if c, ok := b.b.(driver.Copier); ok {
+		return wrapError(b.b, c.Copy(ctx, dstKey, srcKey, dopts))
+	}
+	return b.copyByReading(ctx, dstKey, srcKey, dopts)
+}
+
+// copyByReading implements Copy for providers that don't implement
+// driver.Copier.
+func (b *Bucket) copyByReading(ctx context.Context, dstKey, srcKey string, opts *driver.CopyOptions) error {
+	attrs, err := b.b.Attributes(ctx, srcKey)
+	if err != nil {
+		return wrapError(b.b, err)
+	}
+	if opts.BeforeCopy != nil {
+		if err := opts.BeforeCopy(func(interface{}) bool { return false }); err != nil {
+			return err
+		}
+	}
+	wopts := &WriterOptions{
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentLanguage:    attrs.ContentLanguage,
+		ContentType:        attrs.ContentType,
+		Metadata:           attrs.Metadata,
+	}
+	if opts.ContentType != "" {
+		wopts.ContentType = opts.ContentType
+	}
+	if opts.Metadata != nil {
+		wopts.Metadata = opts.Metadata
+	}
+	r, err := b.NewReader(ctx, srcKey, nil)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w, err := b.NewWriter(ctx, dstKey, wopts)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		// Abort the write, so that dstKey isn't replaced by a partial copy.
+		cancel()
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// SignedURL returns a URL that can be used to access the blob with the HTTP
+// method opts.Method (GET by default) for the duration specified in
+// opts.Expiry.
 //
 // A nil SignedURLOptions is treated the same as the zero value.
 //
@@ -660,11 +1846,33 @@ func (b *Bucket) SignedURL(ctx context.Context, key string, opts *SignedURLOptio
 	if opts.Expiry < 0 {
 		return "", errors.New("blob.SignedURL: SignedURLOptions.Expiry must be >= 0")
 	}
-	if opts.Expiry == 0 {
-		opts.Expiry = DefaultSignedURLExpiry
+	expiry := opts.Expiry
+	if expiry == 0 {
+		expiry = DefaultSignedURLExpiry
+		if d, ok := b.b.(driver.SignedURLExpiryDefaulter); ok && d.DefaultSignedURLExpiry() > 0 {
+			expiry = d.DefaultSignedURLExpiry()
+		}
+	}
+	method := opts.Method
+	switch method {
+	case "":
+		method = http.MethodGet
+	case http.MethodGet, http.MethodPut, http.MethodHead, http.MethodDelete:
+	default:
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "blob.SignedURL: unsupported SignedURLOptions.Method %q", opts.Method)
+	}
+	if opts.ContentType != "" && method != http.MethodPut {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "blob.SignedURL: SignedURLOptions.ContentType requires Method PUT")
+	}
+	if (opts.ResponseContentType != "" || opts.ResponseContentDisposition != "") && method != http.MethodGet {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "blob.SignedURL: SignedURLOptions.ResponseContentType and ResponseContentDisposition require Method GET")
 	}
 	dopts := driver.SignedURLOptions{
-		Expiry: opts.Expiry,
+		Expiry:                     expiry,
+		Method:                     method,
+		ContentType:                opts.ContentType,
+		ResponseContentType:        opts.ResponseContentType,
+		ResponseContentDisposition: opts.ResponseContentDisposition,
 	}
 	url, err := b.b.SignedURL(ctx, key, &dopts)
 	return url, wrapError(b.b, err)
@@ -673,16 +1881,76 @@ func (b *Bucket) SignedURL(ctx context.Context, key string, opts *SignedURLOptio
 // DefaultSignedURLExpiry is the default duration for SignedURLOptions.Expiry.
 const DefaultSignedURLExpiry = 1 * time.Hour
 
+// CopyOptions sets options for Copy.
+type CopyOptions struct {
+	// ContentType, if not empty, is the MIME type of the copy, instead of
+	// that of the source blob.
+	ContentType string
+
+	// Metadata, if not nil, holds key/value strings to be associated with the
+	// copy instead of the metadata of the source blob. An empty, non-nil map
+	// clears the metadata. Keys are lowercased, as for
+	// WriterOptions.Metadata.
+	Metadata map[string]string
+
+	// BeforeCopy is a callback that will be called exactly once, before the
+	// copy request is sent to the provider (unless Copy returns an error
+	// before then). Providers that copy by reading and writing the blob
+	// don't expose any types.
+	//
+	// asFunc converts its argument to provider-specific types.
+	// See Bucket.As for more details.
+	BeforeCopy func(asFunc func(interface{}) bool) error
+}
+
 // SignedURLOptions sets options for SignedURL.
 type SignedURLOptions struct {
 	// Expiry sets how long the returned URL is valid for.
-	// Defaults to DefaultSignedURLExpiry.
+	// Defaults to DefaultSignedURLExpiry, unless the provider has its own
+	// default.
 	Expiry time.Duration
+
+	// Method is the HTTP method that can be used with the URL: "GET" to read
+	// the blob, "PUT" to write it (for example, directly from a browser),
+	// "HEAD" to read its attributes, or "DELETE" to delete it. Other methods
+	// are rejected. Defaults to "GET".
+	Method string
+
+	// ContentType, if not empty, is the Content-Type that a PUT with the URL
+	// must send. It is part of the signature, so uploads with any other
+	// Content-Type are rejected. It can only be set if Method is "PUT".
+	ContentType string
+
+	// ResponseContentType and ResponseContentDisposition, if not empty,
+	// override the Content-Type and Content-Disposition headers of the
+	// response to a GET with the URL, instead of those stored with the blob.
+	// For example, a ResponseContentDisposition of
+	// `attachment; filename="report.pdf"` makes browsers download the blob
+	// as report.pdf. They can only be set if Method is "GET".
+	ResponseContentType        string
+	ResponseContentDisposition string
 }
 
 // ReaderOptions sets options for NewReader and NewRangedReader.
-// It is provided for future extensibility.
-type ReaderOptions struct{}
+type ReaderOptions struct {
+	// BeforeRead is a callback that will be called exactly once, before
+	// the read request is sent to the provider (unless NewRangeReader
+	// returns an error before then).
+	//
+	// asFunc converts its argument to provider-specific types.
+	// See Bucket.As for more details.
+	BeforeRead func(asFunc func(interface{}) bool) error
+}
+
+// AttributesOptions sets options for AttributesWithOptions.
+type AttributesOptions struct {
+	// BeforeAttributes is a callback that will be called exactly once,
+	// before the attributes request is sent to the provider.
+	//
+	// asFunc converts its argument to provider-specific types.
+	// See Bucket.As for more details.
+	BeforeAttributes func(asFunc func(interface{}) bool) error
+}
 
 // WriterOptions sets options for NewWriter.
 type WriterOptions struct {
@@ -722,6 +1990,17 @@ type WriterOptions struct {
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Type
 	ContentType string
 
+	// ContentTypeOverrides refines the inferred content type when ContentType
+	// is not set, combining the sniffed type with the key's extension. The
+	// content type of the blob is chosen as follows:
+	//  1. ContentType, if set; ContentTypeOverrides is ignored.
+	//  2. The ContentType of the first override that matches.
+	//  3. The type sniffed from the content.
+	// For example, to store CSV files (which sniff as "text/plain") as
+	// "text/csv":
+	//  []ContentTypeOverride{{Sniffed: "text/plain", Ext: ".csv", ContentType: "text/csv"}}
+	ContentTypeOverrides []ContentTypeOverride
+
 	// ContentMD5 is used as a message integrity check.
 	// If len(ContentMD5) > 0, the MD5 hash of the bytes written must match
 	// ContentMD5, or Close will return an error without completing the write.
@@ -745,6 +2024,29 @@ type WriterOptions struct {
 	BeforeWrite func(asFunc func(interface{}) bool) error
 }
 
+// ContentTypeOverride is used in WriterOptions.ContentTypeOverrides.
+// It matches when both Sniffed and Ext match; an empty field matches
+// anything.
+type ContentTypeOverride struct {
+	// Sniffed is the media type detected from the content, without
+	// parameters (e.g., "text/plain" rather than "text/plain; charset=utf-8").
+	Sniffed string
+	// Ext is the extension of the key, including the leading dot (e.g.,
+	// ".csv"). It is compared case-insensitively.
+	Ext string
+	// ContentType is the content type to use when the override matches.
+	ContentType string
+}
+
+// matches reports whether o applies to a blob with the given key and
+// sniffed media type.
+func (o *ContentTypeOverride) matches(key, sniffed string) bool {
+	if o.Sniffed != "" && !strings.EqualFold(o.Sniffed, sniffed) {
+		return false
+	}
+	return o.Ext == "" || strings.EqualFold(o.Ext, path.Ext(key))
+}
+
 // FromURLFunc is intended for use by provider implementations.
 // It allows providers to convert a parsed URL from Open to a driver.Bucket.
 type FromURLFunc func(context.Context, *url.URL) (driver.Bucket, error)
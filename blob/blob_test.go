@@ -15,13 +15,22 @@
 package blob
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"gocloud.dev/blob/driver"
@@ -219,6 +228,971 @@ func TestErrorsAreWrapped(t *testing.T) {
 	verifyWrap("SignedURL", err)
 }
 
+var errNotFound = errors.New("not found")
+
+// fakeBucket implements driver.Bucket over an in-memory map of blobs.
+// Only the methods needed by the tests that use it are implemented.
+type fakeBucket struct {
+	driver.Bucket
+	blobs        map[string][]byte
+	contentTypes map[string]string
+	metadata     map[string]map[string]string
+	listCalls    int32 // accessed atomically
+	rangeReads   int32 // accessed atomically
+
+	signedURLOpts *driver.SignedURLOptions
+}
+
+type fakeWriter struct {
+	driver.Writer
+	b   *fakeBucket
+	key string
+	buf bytes.Buffer
+}
+
+func (w *fakeWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *fakeWriter) Close() error {
+	w.b.blobs[w.key] = w.buf.Bytes()
+	return nil
+}
+
+func (b *fakeBucket) NewTypedWriter(ctx context.Context, key string, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
+	if b.blobs == nil {
+		b.blobs = map[string][]byte{}
+	}
+	if b.contentTypes == nil {
+		b.contentTypes = map[string]string{}
+	}
+	b.contentTypes[key] = contentType
+	if b.metadata == nil {
+		b.metadata = map[string]map[string]string{}
+	}
+	b.metadata[key] = opts.Metadata
+	return &fakeWriter{b: b, key: key}, nil
+}
+
+func (b *fakeBucket) Attributes(ctx context.Context, key string) (driver.Attributes, error) {
+	data, ok := b.blobs[key]
+	if !ok {
+		return driver.Attributes{}, errNotFound
+	}
+	return driver.Attributes{
+		ContentType: b.contentTypes[key],
+		Metadata:    b.metadata[key],
+		Size:        int64(len(data)),
+	}, nil
+}
+
+func TestExists(t *testing.T) {
+	ctx := context.Background()
+	b := NewBucket(&fakeBucket{blobs: map[string][]byte{"a": nil}})
+	for _, test := range []struct {
+		key  string
+		want bool
+	}{
+		{"a", true},
+		{"b", false},
+	} {
+		got, err := b.Exists(ctx, test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("Exists(%q): got %v want %v", test.key, got, test.want)
+		}
+	}
+}
+
+func TestAttributesWithOptions(t *testing.T) {
+	ctx := context.Background()
+	b := NewBucket(&fakeBucket{blobs: map[string][]byte{"a": []byte("abc")}})
+	var calls int
+	attrs, err := b.AttributesWithOptions(ctx, "a", &AttributesOptions{
+		BeforeAttributes: func(asFunc func(interface{}) bool) error {
+			calls++
+			var s string
+			if asFunc(&s) {
+				t.Error("asFunc succeeded for a driver without AttributeGetter")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("BeforeAttributes called %d times, want 1", calls)
+	}
+	if attrs.Size != 3 {
+		t.Errorf("got size %d want 3", attrs.Size)
+	}
+
+	wantErr := errors.New("fail")
+	_, err = b.AttributesWithOptions(ctx, "a", &AttributesOptions{
+		BeforeAttributes: func(func(interface{}) bool) error { return wantErr },
+	})
+	if err != wantErr {
+		t.Errorf("got error %v, want %v", err, wantErr)
+	}
+}
+
+type fakeReader struct {
+	driver.Reader
+	r    *bytes.Reader
+	size int64
+}
+
+func (r *fakeReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
+
+func (r *fakeReader) Attributes() driver.ReaderAttributes {
+	return driver.ReaderAttributes{Size: r.size}
+}
+
+func (b *fakeBucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
+	atomic.AddInt32(&b.rangeReads, 1)
+	data, ok := b.blobs[key]
+	if !ok {
+		return nil, errNotFound
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	end := int64(len(data))
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	return &fakeReader{r: bytes.NewReader(data[offset:end]), size: int64(len(data))}, nil
+}
+
+func (b *fakeBucket) ErrorCode(err error) gcerrors.ErrorCode {
+	if err == errNotFound {
+		return gcerrors.NotFound
+	}
+	return gcerrors.Unknown
+}
+
+func (b *fakeBucket) SignedURL(ctx context.Context, key string, opts *driver.SignedURLOptions) (string, error) {
+	b.signedURLOpts = opts
+	return "https://example.com/" + key, nil
+}
+
+func TestSignedURLOptions(t *testing.T) {
+	ctx := context.Background()
+	fb := &fakeBucket{}
+	b := NewBucket(fb)
+	for _, test := range []struct {
+		name     string
+		opts     *SignedURLOptions
+		want     *driver.SignedURLOptions
+		wantCode gcerrors.ErrorCode
+	}{
+		{name: "default", want: &driver.SignedURLOptions{Expiry: DefaultSignedURLExpiry, Method: "GET"}},
+		{name: "PUT", opts: &SignedURLOptions{Method: "PUT", ContentType: "text/plain"}, want: &driver.SignedURLOptions{Expiry: DefaultSignedURLExpiry, Method: "PUT", ContentType: "text/plain"}},
+		{name: "HEAD", opts: &SignedURLOptions{Method: "HEAD"}, want: &driver.SignedURLOptions{Expiry: DefaultSignedURLExpiry, Method: "HEAD"}},
+		{name: "DELETE", opts: &SignedURLOptions{Method: "DELETE", Expiry: time.Minute}, want: &driver.SignedURLOptions{Expiry: time.Minute, Method: "DELETE"}},
+		{name: "unsupported method", opts: &SignedURLOptions{Method: "POST"}, wantCode: gcerrors.InvalidArgument},
+		{name: "lowercase method", opts: &SignedURLOptions{Method: "get"}, wantCode: gcerrors.InvalidArgument},
+		{name: "content type without PUT", opts: &SignedURLOptions{ContentType: "text/plain"}, wantCode: gcerrors.InvalidArgument},
+		{name: "response overrides", opts: &SignedURLOptions{ResponseContentType: "text/csv", ResponseContentDisposition: "attachment"}, want: &driver.SignedURLOptions{Expiry: DefaultSignedURLExpiry, Method: "GET", ResponseContentType: "text/csv", ResponseContentDisposition: "attachment"}},
+		{name: "response overrides without GET", opts: &SignedURLOptions{Method: "PUT", ResponseContentDisposition: "attachment"}, wantCode: gcerrors.InvalidArgument},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fb.signedURLOpts = nil
+			_, err := b.SignedURL(ctx, "key", test.opts)
+			if got := gcerrors.Code(err); got != test.wantCode {
+				t.Fatalf("got error %v, want code %v", err, test.wantCode)
+			}
+			if diff := cmp.Diff(fb.signedURLOpts, test.want); diff != "" {
+				t.Errorf("driver options (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMultiReader(t *testing.T) {
+	ctx := context.Background()
+	b := NewBucket(&fakeBucket{blobs: map[string][]byte{
+		"part1": []byte("hello, "),
+		"part2": {},
+		"part3": []byte("world"),
+	}})
+
+	r := b.NewMultiReader(ctx, []string{"part1", "part2", "part3"}, nil)
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello, world"; string(got) != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+
+	r = b.NewMultiReader(ctx, []string{"part1", "missing", "part3"}, nil)
+	defer r.Close()
+	got, err = ioutil.ReadAll(r)
+	if gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("got error %v want NotFound", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), `"missing"`) {
+		t.Errorf("got error %v, want it to name the missing key", err)
+	}
+	if want := "hello, "; string(got) != want {
+		t.Errorf("got %q before the error, want %q", got, want)
+	}
+}
+
+func TestArchiveToWriter(t *testing.T) {
+	ctx := context.Background()
+	blobs := map[string][]byte{
+		"a.txt":     []byte("hello"),
+		"dir/b.txt": []byte("world"),
+		"empty":     {},
+	}
+	b := NewBucket(&fakeBucket{blobs: blobs})
+	keys := []string{"a.txt", "dir/b.txt", "empty"}
+
+	t.Run("zip", func(t *testing.T) {
+		var buf bytes.Buffer
+		failures, err := b.ArchiveToWriter(ctx, keys, &buf, ArchiveZip, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(failures) != 0 {
+			t.Errorf("got failures %v want none", failures)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zr.File) != len(keys) {
+			t.Fatalf("got %d entries want %d", len(zr.File), len(keys))
+		}
+		for i, f := range zr.File {
+			if f.Name != keys[i] {
+				t.Errorf("entry %d: got name %q want %q", i, f.Name, keys[i])
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, blobs[f.Name]) {
+				t.Errorf("%s: got %q want %q", f.Name, got, blobs[f.Name])
+			}
+		}
+	})
+
+	t.Run("tar skipping missing", func(t *testing.T) {
+		var buf bytes.Buffer
+		opts := &ArchiveOptions{SkipMissing: true, FailureManifest: "FAILURES.txt"}
+		failures, err := b.ArchiveToWriter(ctx, []string{"a.txt", "missing", "dir/b.txt"}, &buf, ArchiveTar, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(failures) != 1 || failures[0].Key != "missing" {
+			t.Errorf("got failures %v want one for %q", failures, "missing")
+		}
+		got := map[string]string{}
+		var names []string
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+			got[hdr.Name] = string(data)
+		}
+		if want := []string{"a.txt", "dir/b.txt", "FAILURES.txt"}; !cmp.Equal(names, want) {
+			t.Errorf("got entries %v want %v", names, want)
+		}
+		if got["dir/b.txt"] != "world" {
+			t.Errorf("got dir/b.txt %q want %q", got["dir/b.txt"], "world")
+		}
+		if !strings.HasPrefix(got["FAILURES.txt"], "missing: ") {
+			t.Errorf("got manifest %q, want it to list %q", got["FAILURES.txt"], "missing")
+		}
+	})
+
+	t.Run("abort on missing", func(t *testing.T) {
+		_, err := b.ArchiveToWriter(ctx, []string{"a.txt", "missing"}, ioutil.Discard, ArchiveZip, nil)
+		if gcerrors.Code(err) != gcerrors.NotFound {
+			t.Errorf("got error %v want NotFound", err)
+		}
+		if err == nil || !strings.Contains(err.Error(), `"missing"`) {
+			t.Errorf("got error %v, want it to name the missing key", err)
+		}
+	})
+}
+
+var errReset = errors.New("connection reset")
+
+// flakyBucket is a fakeBucket whose readers fail with errReset at a random
+// offset, the first faults times they are opened.
+type flakyBucket struct {
+	*fakeBucket
+	rand   *rand.Rand
+	faults int
+}
+
+func (b *flakyBucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
+	r, err := b.fakeBucket.NewRangeReader(ctx, key, offset, length, opts)
+	if err != nil || b.faults == 0 {
+		return r, err
+	}
+	b.faults--
+	fr := r.(*fakeReader)
+	return &flakyReader{fakeReader: fr, left: b.rand.Int63n(int64(fr.r.Len()) + 1)}, nil
+}
+
+// flakyReader fails with errReset after reading left bytes.
+type flakyReader struct {
+	*fakeReader
+	left int64
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, errReset
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.fakeReader.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
+
+func TestResilientReader(t *testing.T) {
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 100000)
+	rnd.Read(data)
+	fb := &fakeBucket{blobs: map[string][]byte{"key": data}}
+
+	t.Run("resumes after resets", func(t *testing.T) {
+		b := NewBucket(&flakyBucket{fakeBucket: fb, rand: rnd, faults: 5})
+		r, err := b.NewResilientReader(ctx, "key", &ResilientReaderOptions{MaxRetries: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("got different content than was written")
+		}
+		if r.BytesRead() != int64(len(data)) {
+			t.Errorf("got BytesRead %d want %d", r.BytesRead(), len(data))
+		}
+		if r.Retries() != 5 {
+			t.Errorf("got %d retries want 5", r.Retries())
+		}
+	})
+
+	t.Run("budget exhausted", func(t *testing.T) {
+		b := NewBucket(&flakyBucket{fakeBucket: fb, rand: rnd, faults: 100})
+		r, err := b.NewResilientReader(ctx, "key", &ResilientReaderOptions{MaxRetries: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		got, err := ioutil.ReadAll(r)
+		if err == nil || !strings.Contains(err.Error(), "after 2 retries") {
+			t.Errorf("got error %v, want one after 2 retries", err)
+		}
+		if !bytes.Equal(got, data[:len(got)]) {
+			t.Error("got different content than was written before the error")
+		}
+		if r.BytesRead() != int64(len(got)) {
+			t.Errorf("got BytesRead %d want %d", r.BytesRead(), len(got))
+		}
+	})
+
+	t.Run("blob deleted", func(t *testing.T) {
+		fb := &fakeBucket{blobs: map[string][]byte{"key": data}}
+		b := NewBucket(&flakyBucket{fakeBucket: fb, rand: rnd, faults: 1})
+		r, err := b.NewResilientReader(ctx, "key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		delete(fb.blobs, "key")
+		if _, err := ioutil.ReadAll(r); gcerrors.Code(err) != gcerrors.NotFound {
+			t.Errorf("got error %v want NotFound", err)
+		}
+		if r.Retries() != 1 {
+			t.Errorf("got %d retries want 1", r.Retries())
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		b := NewBucket(fb)
+		if _, err := b.NewResilientReader(ctx, "missing", nil); gcerrors.Code(err) != gcerrors.NotFound {
+			t.Errorf("got error %v want NotFound", err)
+		}
+	})
+}
+
+// slowBucket is a fakeBucket whose readers each read at a limited rate,
+// like connections over a high-latency link. It tracks how many readers are
+// open at once.
+type slowBucket struct {
+	*fakeBucket
+	bytesPerMs int // if 0, reads are not slowed down
+
+	open, maxOpen int32 // accessed atomically
+}
+
+func (b *slowBucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
+	r, err := b.fakeBucket.NewRangeReader(ctx, key, offset, length, opts)
+	if err != nil {
+		return nil, err
+	}
+	n := atomic.AddInt32(&b.open, 1)
+	for {
+		max := atomic.LoadInt32(&b.maxOpen)
+		if n <= max || atomic.CompareAndSwapInt32(&b.maxOpen, max, n) {
+			break
+		}
+	}
+	return &slowReader{fakeReader: r.(*fakeReader), b: b}, nil
+}
+
+type slowReader struct {
+	*fakeReader
+	b     *slowBucket
+	start time.Time
+	n     int
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	n, err := r.fakeReader.Read(p)
+	if r.b.bytesPerMs > 0 {
+		if r.start.IsZero() {
+			r.start = time.Now()
+		}
+		r.n += n
+		time.Sleep(time.Until(r.start.Add(time.Duration(r.n) * time.Millisecond / time.Duration(r.b.bytesPerMs))))
+	}
+	return n, err
+}
+
+func (r *slowReader) Close() error {
+	atomic.AddInt32(&r.b.open, -1)
+	return nil
+}
+
+func TestPrefetchReader(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+	fb := &fakeBucket{blobs: map[string][]byte{"key": data, "empty": {}}}
+
+	for _, test := range []struct {
+		name        string
+		key         string
+		chunkSize   int64
+		concurrency int
+		readSize    int
+	}{
+		{"chunks divide size", "key", 1000, 3, 64},
+		{"partial last chunk", "key", 999, 3, 64},
+		{"reads span chunks", "key", 100, 2, 1000},
+		{"single chunk", "key", 20000, 4, 512},
+		{"empty", "empty", 100, 2, 64},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sb := &slowBucket{fakeBucket: fb}
+			b := NewBucket(sb)
+			r, err := b.NewPrefetchReader(ctx, test.key, &PrefetchReaderOptions{ChunkSize: test.chunkSize, Concurrency: test.concurrency})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := int64(len(fb.blobs[test.key])); r.Size() != want {
+				t.Errorf("got Size %d want %d", r.Size(), want)
+			}
+			var got []byte
+			buf := make([]byte, test.readSize)
+			for {
+				n, err := r.Read(buf)
+				got = append(got, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n, err := r.Read(buf); n != 0 || err != io.EOF {
+				t.Errorf("got (%d, %v) after EOF, want (0, EOF)", n, err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, fb.blobs[test.key]) {
+				t.Error("got different content than was written")
+			}
+			if max := atomic.LoadInt32(&sb.maxOpen); max > int32(test.concurrency) {
+				t.Errorf("got %d concurrent range reads, want at most %d", max, test.concurrency)
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		b := NewBucket(fb)
+		if _, err := b.NewPrefetchReader(ctx, "missing", nil); gcerrors.Code(err) != gcerrors.NotFound {
+			t.Errorf("got error %v want NotFound", err)
+		}
+	})
+
+	t.Run("close early", func(t *testing.T) {
+		sb := &slowBucket{fakeBucket: fb}
+		b := NewBucket(sb)
+		r, err := b.NewPrefetchReader(ctx, "key", &PrefetchReaderOptions{ChunkSize: 100, Concurrency: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Read(make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if open := atomic.LoadInt32(&sb.open); open != 0 {
+			t.Errorf("got %d range reads still open after Close, want 0", open)
+		}
+		if _, err := r.Read(make([]byte, 10)); err == nil || err == io.EOF {
+			t.Errorf("got error %v reading after Close, want an error", err)
+		}
+	})
+}
+
+func BenchmarkPrefetchReader(b *testing.B) {
+	ctx := context.Background()
+	data := make([]byte, 8<<20)
+	fb := &fakeBucket{blobs: map[string][]byte{"key": data}}
+	// Each range read transfers at most 64 KiB per millisecond.
+	bkt := NewBucket(&slowBucket{fakeBucket: fb, bytesPerMs: 64 << 10})
+
+	read := func(b *testing.B, open func() (io.ReadCloser, error)) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			r, err := open()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				b.Fatal(err)
+			}
+			r.Close()
+		}
+	}
+	b.Run("single stream", func(b *testing.B) {
+		read(b, func() (io.ReadCloser, error) { return bkt.NewReader(ctx, "key", nil) })
+	})
+	for _, concurrency := range []int{2, 4, 8} {
+		b.Run(fmt.Sprintf("prefetch concurrency %d", concurrency), func(b *testing.B) {
+			read(b, func() (io.ReadCloser, error) {
+				return bkt.NewPrefetchReader(ctx, "key", &PrefetchReaderOptions{ChunkSize: 1 << 20, Concurrency: concurrency})
+			})
+		})
+	}
+}
+
+var errDeleteFailed = errors.New("delete failed")
+
+func (b *fakeBucket) Delete(ctx context.Context, key string) error {
+	if key == "undeletable" {
+		return errDeleteFailed
+	}
+	if _, ok := b.blobs[key]; !ok {
+		return errNotFound
+	}
+	delete(b.blobs, key)
+	return nil
+}
+
+func TestDeleteAll(t *testing.T) {
+	ctx := context.Background()
+	fb := &fakeBucket{blobs: map[string][]byte{"a": nil, "b": nil, "c": nil, "undeletable": nil}}
+	b := NewBucket(fb)
+
+	if err := b.DeleteAll(ctx, []string{"a", "missing"}); err != nil {
+		t.Fatalf("got error %v want nil; missing keys are not errors", err)
+	}
+	err := b.DeleteAll(ctx, []string{"b", "undeletable", "c"})
+	dae, ok := err.(*DeleteAllError)
+	if !ok {
+		t.Fatalf("got error %v want a *DeleteAllError", err)
+	}
+	if len(dae.Errors) != 1 || dae.Errors["undeletable"] == nil {
+		t.Errorf("got errors %v, want one for %q", dae.Errors, "undeletable")
+	}
+	if !strings.Contains(err.Error(), `"undeletable"`) {
+		t.Errorf("got error %q, want it to name the key", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, ok := fb.blobs[key]; ok {
+			t.Errorf("%q was not deleted", key)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	fb := &fakeBucket{}
+	b := NewBucket(fb)
+	if err := b.WriteAll(ctx, "src", []byte("hello"), &WriterOptions{ContentType: "text/plain", Metadata: map[string]string{"k": "v"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		opts     *CopyOptions
+		wantType string
+		wantMD   map[string]string
+	}{
+		{"keeps attributes", nil, "text/plain", map[string]string{"k": "v"}},
+		{"content type", &CopyOptions{ContentType: "text/csv"}, "text/csv", map[string]string{"k": "v"}},
+		{"metadata", &CopyOptions{Metadata: map[string]string{"Other": "x"}}, "text/plain", map[string]string{"other": "x"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := b.Copy(ctx, "dst", "src", test.opts); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(fb.blobs["dst"]); got != "hello" {
+				t.Errorf("got content %q want %q", got, "hello")
+			}
+			if got := fb.contentTypes["dst"]; got != test.wantType {
+				t.Errorf("got content type %q want %q", got, test.wantType)
+			}
+			if got := fb.metadata["dst"]; !cmp.Equal(got, test.wantMD) {
+				t.Errorf("got metadata %v want %v", got, test.wantMD)
+			}
+		})
+	}
+
+	if err := b.Copy(ctx, "dst", "missing", nil); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("got error %v want NotFound", err)
+	}
+}
+
+func (b *fakeBucket) ListPaged(ctx context.Context, opts *driver.ListOptions) (*driver.ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range b.blobs {
+		if strings.HasPrefix(key, opts.Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	page := &driver.ListPage{}
+	if len(opts.PageToken) > 0 {
+		start, _ := strconv.Atoi(string(opts.PageToken))
+		keys = keys[start:]
+	}
+	if opts.PageSize > 0 && len(keys) > opts.PageSize {
+		start, _ := strconv.Atoi(string(opts.PageToken))
+		page.NextPageToken = []byte(strconv.Itoa(start + opts.PageSize))
+		keys = keys[:opts.PageSize]
+	}
+	for _, key := range keys {
+		page.Objects = append(page.Objects, &driver.ListObject{Key: key, Size: int64(len(b.blobs[key]))})
+	}
+	atomic.AddInt32(&b.listCalls, 1)
+	return page, nil
+}
+
+func TestListN(t *testing.T) {
+	ctx := context.Background()
+	fb := &fakeBucket{blobs: map[string][]byte{"a/1": nil, "a/2": nil, "a/3": nil, "b/1": nil}}
+	b := NewBucket(fb)
+	for _, test := range []struct {
+		prefix string
+		n      int
+		want   []string
+	}{
+		{"a/", 2, []string{"a/1", "a/2"}},
+		{"a/", 3, []string{"a/1", "a/2", "a/3"}},
+		{"a/", 10, []string{"a/1", "a/2", "a/3"}},
+		{"", 4, []string{"a/1", "a/2", "a/3", "b/1"}},
+		{"c/", 1, nil},
+		{"a/", 0, nil},
+	} {
+		atomic.StoreInt32(&fb.listCalls, 0)
+		objs, err := b.ListN(ctx, test.prefix, test.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, obj := range objs {
+			got = append(got, obj.Key)
+		}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("ListN(%q, %d): got %v want %v", test.prefix, test.n, got, test.want)
+		}
+		if calls := atomic.LoadInt32(&fb.listCalls); calls > 2 {
+			t.Errorf("ListN(%q, %d): got %d list calls, want at most 2", test.prefix, test.n, calls)
+		}
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := b.ListN(cancelCtx, "", 2); err != context.Canceled {
+		t.Errorf("with canceled ctx, got error %v want context.Canceled", err)
+	}
+}
+
+func TestForEachObject(t *testing.T) {
+	ctx := context.Background()
+	b := NewBucket(&fakeBucket{blobs: map[string][]byte{"a/1": nil, "a/2": nil, "a/3": nil, "b/1": nil}})
+
+	var got []string
+	err := b.ForEachObject(ctx, "a/", "", func(obj *ListObject) error {
+		got = append(got, obj.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/1", "a/2", "a/3"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	errStop := errors.New("stop")
+	got = nil
+	err = b.ForEachObject(ctx, "", "", func(obj *ListObject) error {
+		got = append(got, obj.Key)
+		if obj.Key == "a/2" {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("got error %v want %v", err, errStop)
+	}
+	if want := []string{"a/1", "a/2"}; !cmp.Equal(got, want) {
+		t.Errorf("after error, got %v want %v", got, want)
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	got = nil
+	err = b.ForEachObject(cancelCtx, "", "", func(obj *ListObject) error {
+		got = append(got, obj.Key)
+		cancel()
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("after cancel, got error %v want context.Canceled", err)
+	}
+	if want := []string{"a/1"}; !cmp.Equal(got, want) {
+		t.Errorf("after cancel, got %v want %v", got, want)
+	}
+}
+
+func TestListPrefixes(t *testing.T) {
+	ctx := context.Background()
+	b := NewBucket(&fakeBucket{blobs: map[string][]byte{
+		"b/1": nil,
+		"b/2": nil,
+		"a/1": nil,
+		"c/1": nil,
+	}})
+	keys := func(objs []*ListObject) []string {
+		var keys []string
+		for _, obj := range objs {
+			keys = append(keys, obj.Key)
+		}
+		return keys
+	}
+
+	objs, errs := b.ListPrefixes(ctx, []string{"b/", "a/", "none/"}, &ListPrefixesOptions{MaxConcurrency: 1})
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if got, want := keys(objs), []string{"b/1", "b/2", "a/1"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	objs, errs = b.ListPrefixes(ctx, []string{"b/", "a/", "c/"}, &ListPrefixesOptions{Sort: true})
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if got, want := keys(objs), []string{"a/1", "b/1", "b/2", "c/1"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	objs, errs = b.ListPrefixes(cancelCtx, []string{"a/", "b/"}, nil)
+	if len(objs) != 0 || len(errs) != 2 {
+		t.Errorf("with canceled ctx, got %d objects and errors %v, want none and 2 errors", len(objs), errs)
+	}
+}
+
+func TestListPrefixesForEach(t *testing.T) {
+	ctx := context.Background()
+	blobs := map[string][]byte{"c/1": nil, "d": nil}
+	// More blobs than are buffered for a prefix that isn't being consumed.
+	for i := 0; i < listPrefixesBuffer+10; i++ {
+		blobs[fmt.Sprintf("a/%05d", i)] = nil
+		blobs[fmt.Sprintf("b/%05d", i)] = nil
+	}
+	b := NewBucket(&fakeBucket{blobs: blobs})
+	var want []string
+	for key := range blobs {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+	forEach := func(prefixes []string, opts *ListPrefixesOptions) ([]string, map[string]error) {
+		var got []string
+		opts.ForEach = func(obj *ListObject) error {
+			got = append(got, obj.Key)
+			return nil
+		}
+		objs, errs := b.ListPrefixes(ctx, prefixes, opts)
+		if len(objs) != 0 {
+			t.Errorf("%v: got %d objects returned, want none", prefixes, len(objs))
+		}
+		return got, errs
+	}
+
+	got, errs := forEach([]string{"b/", "a/", "c/", "d"}, &ListPrefixesOptions{MaxConcurrency: 1, Sort: true})
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("sorted: got keys diff (-got +want):\n%s", diff)
+	}
+	// Without Sort, the blobs are grouped by prefix in the given order.
+	got, errs = forEach([]string{"c/", "a/"}, &ListPrefixesOptions{MaxConcurrency: 2})
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if len(got) != listPrefixesBuffer+11 || got[0] != "c/1" || got[1] != "a/00000" {
+		t.Errorf("unsorted: got %d keys starting with %v, want %d starting with c/1, a/00000", len(got), got[:2], listPrefixesBuffer+11)
+	}
+
+	if _, errs := forEach([]string{"a/", "a/0"}, &ListPrefixesOptions{Sort: true}); gcerrors.Code(errs["a/0"]) != gcerrors.InvalidArgument {
+		t.Errorf("with overlapping prefixes, got errors %v, want InvalidArgument for a/0", errs)
+	}
+
+	// An error from ForEach stops the listing.
+	errStop := errors.New("stop")
+	var calls int
+	_, errs = b.ListPrefixes(ctx, []string{"a/", "b/"}, &ListPrefixesOptions{
+		ForEach: func(*ListObject) error {
+			calls++
+			return errStop
+		},
+	})
+	if len(errs) != 1 || errs["a/"] != errStop {
+		t.Errorf("got errors %v, want %v for a/", errs, errStop)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls to ForEach, want 1", calls)
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, errs = b.ListPrefixes(cancelCtx, []string{"a/", "b/"}, &ListPrefixesOptions{ForEach: func(*ListObject) error { return nil }})
+	if len(errs) != 1 || errs["a/"] == nil {
+		t.Errorf("with canceled ctx, got errors %v, want one for a/", errs)
+	}
+}
+
+func TestLookupMetadata(t *testing.T) {
+	a := &Attributes{Metadata: map[string]string{"user-id": "42", "Mixed": "x"}}
+	for _, tc := range []struct {
+		key    string
+		want   string
+		wantOK bool
+	}{
+		{"user-id", "42", true},
+		{"User-Id", "42", true},
+		{"USER-ID", "42", true},
+		{"mixed", "x", true},
+		{"missing", "", false},
+	} {
+		got, ok := a.LookupMetadata(tc.key)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("LookupMetadata(%q): got (%q, %v) want (%q, %v)", tc.key, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestContentTypeOverrides(t *testing.T) {
+	ctx := context.Background()
+	overrides := []ContentTypeOverride{
+		{Sniffed: "text/plain", Ext: ".csv", ContentType: "text/csv"},
+		{Sniffed: "application/octet-stream", Ext: ".bin", ContentType: "application/x-custom"},
+		{Ext: ".parquet", ContentType: "application/x-parquet"},
+	}
+	csv := []byte("a,b,c\n1,2,3\n")
+	binary := []byte{0x00, 0x01, 0xfe, 0xff}
+	for _, tc := range []struct {
+		name        string
+		key         string
+		content     []byte
+		contentType string
+		want        string
+	}{
+		{"CSV", "data.csv", csv, "", "text/csv"},
+		{"CSV extension is case-insensitive", "DATA.CSV", csv, "", "text/csv"},
+		{"CSV extension with binary content", "data.csv", binary, "", "application/octet-stream"},
+		{"text without CSV extension", "data.txt", csv, "", "text/plain; charset=utf-8"},
+		{"custom binary", "blob.bin", binary, "", "application/x-custom"},
+		{"custom binary with text content", "blob.bin", csv, "", "text/plain; charset=utf-8"},
+		{"extension only", "table.parquet", csv, "", "application/x-parquet"},
+		{"explicit ContentType wins", "data.csv", csv, "application/json", "application/json"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fb := &fakeBucket{}
+			b := NewBucket(fb)
+			opts := &WriterOptions{ContentType: tc.contentType, ContentTypeOverrides: overrides}
+			if err := b.WriteAll(ctx, tc.key, tc.content, opts); err != nil {
+				t.Fatal(err)
+			}
+			if got := fb.contentTypes[tc.key]; got != tc.want {
+				t.Errorf("got content type %q want %q", got, tc.want)
+			}
+		})
+	}
+
+	b := NewBucket(&fakeBucket{})
+	opts := &WriterOptions{ContentTypeOverrides: []ContentTypeOverride{{Ext: ".csv", ContentType: "not a type;;"}}}
+	if _, err := b.NewWriter(ctx, "data.csv", opts); err == nil {
+		t.Error("got nil error for an invalid override ContentType, want error")
+	}
+}
+
 // TestOpen tests blob.Open.
 func TestOpen(t *testing.T) {
 	ctx := context.Background()
@@ -303,3 +1277,63 @@ func TestOpen(t *testing.T) {
 		})
 	}
 }
+
+func TestReadRanges(t *testing.T) {
+	ctx := context.Background()
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	for _, test := range []struct {
+		name      string
+		ranges    []ByteRange
+		maxGap    int64
+		wantReads int32
+	}{
+		{name: "no ranges"},
+		{name: "single", ranges: []ByteRange{{10, 5}}, wantReads: 1},
+		{name: "within gap", ranges: []ByteRange{{10, 5}, {20, 5}}, maxGap: 5, wantReads: 1},
+		{name: "beyond gap", ranges: []ByteRange{{10, 5}, {21, 5}}, maxGap: 5, wantReads: 2},
+		{name: "unordered", ranges: []ByteRange{{500, 10}, {0, 10}, {505, 20}, {15, 1}}, maxGap: 10, wantReads: 2},
+		{name: "adjacent only", ranges: []ByteRange{{0, 10}, {10, 10}, {21, 1}}, maxGap: -1, wantReads: 2},
+		{name: "default gap", ranges: []ByteRange{{0, 1}, {999, 1}}, wantReads: 1},
+		{name: "contained", ranges: []ByteRange{{0, 100}, {10, 5}}, maxGap: -1, wantReads: 1},
+		{name: "past end", ranges: []ByteRange{{990, 20}, {1200, 5}}, maxGap: -1, wantReads: 2},
+		{name: "empty", ranges: []ByteRange{{5, 0}}, wantReads: 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fb := &fakeBucket{blobs: map[string][]byte{"key": content}}
+			b := NewBucket(fb)
+			got, err := b.ReadRanges(ctx, "key", test.ranges, &ReadRangesOptions{MaxGap: test.maxGap})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(test.ranges) {
+				t.Fatalf("got %d results, want %d", len(got), len(test.ranges))
+			}
+			for i, r := range test.ranges {
+				lo, hi := r.Offset, r.Offset+r.Length
+				if lo > int64(len(content)) {
+					lo = int64(len(content))
+				}
+				if hi > int64(len(content)) {
+					hi = int64(len(content))
+				}
+				if !bytes.Equal(got[i], content[lo:hi]) {
+					t.Errorf("range %v: got %v, want %v", r, got[i], content[lo:hi])
+				}
+			}
+			if fb.rangeReads != test.wantReads {
+				t.Errorf("got %d range reads, want %d", fb.rangeReads, test.wantReads)
+			}
+		})
+	}
+
+	b := NewBucket(&fakeBucket{blobs: map[string][]byte{"key": content}})
+	if _, err := b.ReadRanges(ctx, "key", []ByteRange{{-1, 5}}, nil); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("negative offset: got error %v, want InvalidArgument", err)
+	}
+	if _, err := b.ReadRanges(ctx, "missing", []ByteRange{{0, 5}}, nil); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("missing blob: got error %v, want NotFound", err)
+	}
+}
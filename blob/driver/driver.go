@@ -18,15 +18,24 @@ package driver // import "gocloud.dev/blob/driver"
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"gocloud.dev/gcerrors"
 )
 
 // ReaderOptions controls Reader behaviors.
-// It is provided for future extensibility.
-type ReaderOptions struct{}
+type ReaderOptions struct {
+	// BeforeRead is a callback that must be called exactly once before
+	// the read request is sent to the provider, unless NewRangeReader
+	// returns an error before then.
+	// asFunc allows providers to expose provider-specific types;
+	// see Bucket.As for more details.
+	BeforeRead func(asFunc func(interface{}) bool) error
+}
 
 // Reader reads an object from the blob.
 type Reader interface {
@@ -126,6 +135,25 @@ type Attributes struct {
 	Size int64
 	// MD5 is an MD5 hash of the blob contents or nil if not available.
 	MD5 []byte
+	// ETag is the provider's raw entity tag for the blob, or empty if not
+	// available. It is not necessarily a hash of the blob contents.
+	ETag string
+	// StorageClass is the provider-specific storage class of the blob, or
+	// empty if not available.
+	StorageClass string
+	// ServerSideEncryption is the provider-specific server-side encryption
+	// of the blob, or empty if not available.
+	ServerSideEncryption string
+	// VersionID identifies the version of the blob, or is empty if not
+	// available.
+	VersionID string
+	// RestoreOngoing is true while the blob is being restored from an
+	// archival storage class.
+	RestoreOngoing bool
+	// RestoreExpiry is when the temporary copy of a restored blob expires,
+	// or the zero value if the blob has not been restored (or the restore
+	// is still ongoing).
+	RestoreExpiry time.Time
 	// AsFunc allows providers to expose provider-specific types;
 	// see Bucket.As for more details.
 	// If not set, no provider-specific types are supported.
@@ -199,6 +227,11 @@ type ListPage struct {
 	// subsequent ListPaged call, to fetch the next page of results.
 	// It can be an arbitrary []byte; it need not be a valid key.
 	NextPageToken []byte
+	// AsFunc allows providers to expose provider-specific types for the
+	// page, such as the raw response of the list request;
+	// see Bucket.As for more details.
+	// If not set, no provider-specific types are supported.
+	AsFunc func(interface{}) bool
 }
 
 // Bucket provides read, write and delete operations on objects within it on the
@@ -252,9 +285,12 @@ type Bucket interface {
 
 	// NewRangeReader returns a Reader that reads part of an object, reading at
 	// most length bytes starting at the given offset. If length is negative, it
-	// will read until the end of the object. If the specified object does not
-	// exist, NewRangeReader must return an error for which IsNotExist returns
-	// true.
+	// will read until the end of the object. If offset is negative, length is
+	// guaranteed to be negative too, and the Reader reads the last -offset
+	// bytes of the object (or all of it, if it is shorter); the Reader's
+	// Attributes must still report the size of the entire object.
+	// If the specified object does not exist, NewRangeReader must return an
+	// error for which IsNotExist returns true.
 	// opts is guaranteed to be non-nil.
 	NewRangeReader(ctx context.Context, key string, offset, length int64, opts *ReaderOptions) (Reader, error)
 
@@ -279,15 +315,120 @@ type Bucket interface {
 	// true.
 	Delete(ctx context.Context, key string) error
 
-	// SignedURL returns a URL that can be used to GET the blob for the duration
-	// specified in opts.Expiry. opts is guaranteed to be non-nil.
+	// SignedURL returns a URL that can be used with opts.Method on the blob
+	// for the duration specified in opts.Expiry. opts is guaranteed to be
+	// non-nil.
 	// If not supported, return an error for which IsNotImplemented returns
 	// true.
 	SignedURL(ctx context.Context, key string, opts *SignedURLOptions) (string, error)
 }
 
+// BatchDeleter is an optional interface for a Bucket that can delete
+// multiple objects more efficiently than by calling Delete for each of them.
+type BatchDeleter interface {
+	// DeleteAll deletes the objects associated with keys. It returns the
+	// errors for the keys that could not be deleted, or nil if all were.
+	// Keys that don't exist must not be reported as errors.
+	DeleteAll(ctx context.Context, keys []string) map[string]error
+}
+
+// CopyOptions sets options for Copier.Copy.
+type CopyOptions struct {
+	// ContentType, if not empty, replaces the content type of the source
+	// object.
+	ContentType string
+	// Metadata, if not nil, replaces the metadata of the source object. Its
+	// keys are lowercase.
+	Metadata map[string]string
+	// BeforeCopy is a callback that must be called exactly once before the
+	// copy request is sent, unless Copy fails earlier.
+	//
+	// asFunc converts its argument to provider-specific types.
+	// See Bucket.As for more details.
+	BeforeCopy func(asFunc func(interface{}) bool) error
+}
+
+// Copier is an optional interface for a Bucket that can copy objects
+// without downloading them.
+type Copier interface {
+	// Copy copies the object associated with srcKey to dstKey, keeping the
+	// attributes of the source object unless they are overridden in opts,
+	// which is guaranteed to be non-nil. If the source object does not
+	// exist, Copy must return an error for which ErrorCode returns
+	// gcerrors.NotFound.
+	Copy(ctx context.Context, dstKey, srcKey string, opts *CopyOptions) error
+}
+
+// ExistenceChecker is an optional interface for a Bucket that can check
+// whether an object exists more cheaply than by calling Attributes.
+type ExistenceChecker interface {
+	// Exists reports whether an object is associated with key. It must
+	// return false and a nil error if it doesn't exist, and an error only
+	// if existence could not be determined.
+	Exists(ctx context.Context, key string) (bool, error)
+}
+
+// AttributesOptions controls Attributes behavior.
+type AttributesOptions struct {
+	// BeforeAttributes is a callback that must be called exactly once before
+	// the attributes request is sent to the provider.
+	// asFunc allows providers to expose provider-specific types;
+	// see Bucket.As for more details.
+	BeforeAttributes func(asFunc func(interface{}) bool) error
+}
+
+// AttributeGetter is an optional interface for a Bucket that supports
+// AttributesOptions.
+type AttributeGetter interface {
+	// AttributesWithOptions is like Attributes, with opts, which is
+	// guaranteed to be non-nil.
+	AttributesWithOptions(ctx context.Context, key string, opts *AttributesOptions) (Attributes, error)
+}
+
+// SignedURLExpiryDefaulter is an optional interface for a Bucket whose
+// signed URLs have a default expiry other than the portable type's.
+type SignedURLExpiryDefaulter interface {
+	// DefaultSignedURLExpiry returns the expiry used for SignedURL when
+	// the caller doesn't set one. It is ignored unless it is positive.
+	DefaultSignedURLExpiry() time.Duration
+}
+
 // SignedURLOptions sets options for SignedURL.
 type SignedURLOptions struct {
 	// Expiry sets how long the returned URL is valid for. It is guaranteed to be > 0.
 	Expiry time.Duration
+	// Method is the HTTP method that can be used with the URL. It is
+	// guaranteed to be "GET", "PUT", "HEAD" or "DELETE". Implementations
+	// that don't support a method should return an error rather than
+	// sign the URL for another method.
+	Method string
+	// ContentType, if not empty, is the Content-Type that must be sent with
+	// the URL, and should be included in its signature. It is only set if
+	// Method is "PUT".
+	ContentType string
+	// ResponseContentType and ResponseContentDisposition, if not empty,
+	// override the headers of the response to a GET with the URL. They
+	// are only set if Method is "GET". Implementations that can't
+	// override them should return an error.
+	ResponseContentType        string
+	ResponseContentDisposition string
+}
+
+// LowercaseMetadata returns md with lowercase keys, as passed to drivers in
+// WriterOptions.Metadata and CopyOptions.Metadata. It returns an error if a
+// key is empty or two keys differ only in case. It is exported for drivers
+// that write blobs outside of the portable type.
+func LowercaseMetadata(md map[string]string) (map[string]string, error) {
+	lower := make(map[string]string, len(md))
+	for k, v := range md {
+		if k == "" {
+			return nil, errors.New("keys may not be empty strings")
+		}
+		lowerK := strings.ToLower(k)
+		if _, found := lower[lowerK]; found {
+			return nil, fmt.Errorf("duplicate case-insensitive metadata key %q", lowerK)
+		}
+		lower[lowerK] = v
+	}
+	return lower, nil
 }
@@ -446,6 +446,11 @@ func (b *bucket) Attributes(ctx context.Context, key string) (driver.Attributes,
 
 // NewRangeReader implements driver.NewRangeReader.
 func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
+	if opts.BeforeRead != nil {
+		if err := opts.BeforeRead(func(interface{}) bool { return false }); err != nil {
+			return nil, err
+		}
+	}
 	path, info, xa, err := b.forKey(key)
 	if err != nil {
 		return nil, err
@@ -454,6 +459,10 @@ func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length
 	if err != nil {
 		return nil, err
 	}
+	if offset < 0 {
+		// Read the last -offset bytes.
+		offset += info.Size()
+	}
 	if offset > 0 {
 		if _, err := f.Seek(offset, io.SeekStart); err != nil {
 			return nil, err
@@ -39,6 +39,7 @@
 //  - Error: *googleapi.Error
 //  - ListObject: storage.ObjectAttrs
 //  - ListOptions.BeforeList: *storage.Query
+//  - ReaderOptions.BeforeRead: *storage.ObjectHandle
 //  - Reader: storage.Reader
 //  - Attributes: storage.ObjectAttrs
 //  - WriterOptions.BeforeWrite: *storage.Writer
@@ -316,6 +317,7 @@ func (b *bucket) Attributes(ctx context.Context, key string) (driver.Attributes,
 		ModTime:            attrs.Updated,
 		Size:               attrs.Size,
 		MD5:                attrs.MD5,
+		StorageClass:       attrs.StorageClass,
 		AsFunc: func(i interface{}) bool {
 			p, ok := i.(*storage.ObjectAttrs)
 			if !ok {
@@ -331,6 +333,31 @@ func (b *bucket) Attributes(ctx context.Context, key string) (driver.Attributes,
 func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
 	bkt := b.client.Bucket(b.name)
 	obj := bkt.Object(key)
+	if offset < 0 {
+		// GCS doesn't support reading the last N bytes directly; compute the
+		// offset from the object's size.
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		offset += attrs.Size
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	if opts.BeforeRead != nil {
+		asFunc := func(i interface{}) bool {
+			p, ok := i.(**storage.ObjectHandle)
+			if !ok {
+				return false
+			}
+			*p = obj
+			return true
+		}
+		if err := opts.BeforeRead(asFunc); err != nil {
+			return nil, err
+		}
+	}
 	r, err := obj.NewRangeReader(ctx, offset, length)
 	if err != nil {
 		return nil, err
@@ -389,12 +416,31 @@ func (b *bucket) SignedURL(ctx context.Context, key string, dopts *driver.Signed
 	}
 	opts := &storage.SignedURLOptions{
 		Expires:        time.Now().Add(dopts.Expiry),
-		Method:         "GET",
+		Method:         dopts.Method,
+		ContentType:    dopts.ContentType,
 		GoogleAccessID: b.opts.GoogleAccessID,
 		PrivateKey:     b.opts.PrivateKey,
 		SignBytes:      b.opts.SignBytes,
 	}
-	return storage.SignedURL(b.name, key, opts)
+	s, err := storage.SignedURL(b.name, key, opts)
+	if err != nil || (dopts.ResponseContentType == "" && dopts.ResponseContentDisposition == "") {
+		return s, err
+	}
+	// The response overrides aren't part of the signature, so they are
+	// added to the signed URL.
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if dopts.ResponseContentType != "" {
+		q.Set("response-content-type", dopts.ResponseContentType)
+	}
+	if dopts.ResponseContentDisposition != "" {
+		q.Set("response-content-disposition", dopts.ResponseContentDisposition)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
 }
 
 func bufferSize(size int) int {
@@ -196,6 +196,11 @@ func (b *bucket) Attributes(ctx context.Context, key string) (driver.Attributes,
 
 // NewRangeReader implements driver.NewRangeReader.
 func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
+	if opts.BeforeRead != nil {
+		if err := opts.BeforeRead(func(interface{}) bool { return false }); err != nil {
+			return nil, err
+		}
+	}
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -205,6 +210,10 @@ func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length
 	}
 
 	r := bytes.NewReader(entry.Content)
+	if offset < 0 {
+		// Read the last -offset bytes.
+		offset += int64(len(entry.Content))
+	}
 	if offset > 0 {
 		if _, err := r.Seek(offset, io.SeekStart); err != nil {
 			return nil, err
@@ -15,7 +15,9 @@
 package memblob
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
 	"net/http"
 	"testing"
 
@@ -46,3 +48,33 @@ func TestConformance(t *testing.T) {
 func BenchmarkMemblob(b *testing.B) {
 	drivertest.RunBenchmarks(b, OpenBucket(nil))
 }
+
+func TestSuffixRead(t *testing.T) {
+	ctx := context.Background()
+	b := OpenBucket(nil)
+	content := []byte("abcdefghijklmnopqrstuvwxyz")
+	if err := b.WriteAll(ctx, "key", content, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int64{1, 5, int64(len(content)), 100} {
+		r, err := b.NewRangeReader(ctx, "key", -n, -1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := content
+		if n < int64(len(content)) {
+			want = content[int64(len(content))-n:]
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("last %d bytes: got %q want %q", n, got, want)
+		}
+		if r.Size() != int64(len(content)) {
+			t.Errorf("last %d bytes: got size %d want %d", n, r.Size(), len(content))
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3blob
+
+import (
+	"context"
+
+	"gocloud.dev/blob"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ACL is the access control list of an object.
+// See https://docs.aws.amazon.com/AmazonS3/latest/dev/acl-overview.html.
+type ACL struct {
+	// OwnerID is the canonical user ID of the object's owner.
+	OwnerID string
+	// OwnerName is the display name of the object's owner. S3 only returns
+	// it in some regions, so it may be empty.
+	OwnerName string
+	// Grants are the permissions granted on the object, in the order S3
+	// returns them.
+	Grants []Grant
+
+	asFunc func(interface{}) bool
+}
+
+// As converts i to provider-specific types. It supports
+// *s3.GetObjectAclOutput.
+func (a *ACL) As(i interface{}) bool {
+	if a.asFunc == nil {
+		return false
+	}
+	return a.asFunc(i)
+}
+
+// Grant is a permission granted to a grantee in an ACL.
+type Grant struct {
+	// GranteeType is the type of the grantee: s3.TypeCanonicalUser,
+	// s3.TypeGroup or s3.TypeAmazonCustomerByEmail.
+	GranteeType string
+	// Grantee identifies the grantee: a canonical user ID, a group URI such
+	// as "http://acs.amazonaws.com/groups/global/AllUsers", or an email
+	// address, depending on GranteeType.
+	Grantee string
+	// GranteeName is the display name of a canonical user, if S3 returned
+	// one.
+	GranteeName string
+	// Permission is the permission granted, e.g. s3.PermissionRead or
+	// s3.PermissionFullControl.
+	Permission string
+}
+
+// GetACL returns the access control list of the object stored at key in
+// bkt, which must have been opened by this package. If the object doesn't
+// exist, it returns an error for which gcerrors.Code returns
+// gcerrors.NotFound. Buckets with Object Ownership set to "bucket owner
+// enforced" have ACLs disabled; their objects' ACLs always grant
+// FULL_CONTROL to the bucket owner.
+func GetACL(ctx context.Context, bkt *blob.Bucket, key string) (*ACL, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.GetObjectAclWithContext(ctx, &s3.GetObjectAclInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(b.objectKey(key)),
+	})
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+	acl := &ACL{
+		asFunc: func(i interface{}) bool {
+			p, ok := i.(*s3.GetObjectAclOutput)
+			if !ok {
+				return false
+			}
+			*p = *resp
+			return true
+		},
+	}
+	if o := resp.Owner; o != nil {
+		acl.OwnerID = aws.StringValue(o.ID)
+		acl.OwnerName = aws.StringValue(o.DisplayName)
+	}
+	for _, g := range resp.Grants {
+		grant := Grant{Permission: aws.StringValue(g.Permission)}
+		if ge := g.Grantee; ge != nil {
+			grant.GranteeType = aws.StringValue(ge.Type)
+			if grant.GranteeType == "" {
+				// The AWS SDK doesn't decode the xsi:type attribute, so
+				// infer the type from the field that is set.
+				switch {
+				case ge.URI != nil:
+					grant.GranteeType = s3.TypeGroup
+				case ge.EmailAddress != nil:
+					grant.GranteeType = s3.TypeAmazonCustomerByEmail
+				default:
+					grant.GranteeType = s3.TypeCanonicalUser
+				}
+			}
+			grant.GranteeName = aws.StringValue(ge.DisplayName)
+			switch grant.GranteeType {
+			case s3.TypeGroup:
+				grant.Grantee = aws.StringValue(ge.URI)
+			case s3.TypeAmazonCustomerByEmail:
+				grant.Grantee = aws.StringValue(ge.EmailAddress)
+			default:
+				grant.Grantee = aws.StringValue(ge.ID)
+			}
+		}
+		acl.Grants = append(acl.Grants, grant)
+	}
+	return acl, nil
+}
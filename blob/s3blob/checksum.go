@@ -0,0 +1,360 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3blob
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/internal/gcerr"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The headers of S3's additional checksums, which the version of the AWS SDK
+// used by this package does not model. Each algorithm has its own checksum
+// header, "X-Amz-Checksum-" followed by the algorithm's name.
+// See https://docs.aws.amazon.com/AmazonS3/latest/userguide/checking-object-integrity.html.
+const (
+	checksumAlgorithmHeader = "X-Amz-Checksum-Algorithm"
+	checksumModeHeader      = "X-Amz-Checksum-Mode"
+)
+
+// The checksum algorithms S3 supports; see WriterOptions.ChecksumAlgorithm.
+const (
+	ChecksumCRC32  = "CRC32"
+	ChecksumCRC32C = "CRC32C"
+	ChecksumSHA1   = "SHA1"
+	ChecksumSHA256 = "SHA256"
+)
+
+// checksumAlgorithm is one of S3's additional checksum algorithms.
+type checksumAlgorithm struct {
+	// name is the algorithm's name in S3's API, e.g. "SHA256".
+	name string
+	// newHash returns a hash computing the checksum.
+	newHash func() hash.Hash
+}
+
+// header returns the name of the header holding a checksum computed with a.
+func (a *checksumAlgorithm) header() string {
+	return http.CanonicalHeaderKey("X-Amz-Checksum-" + a.name)
+}
+
+// element returns the name of the XML element holding a checksum computed
+// with a.
+func (a *checksumAlgorithm) element() string {
+	return "Checksum" + a.name
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumAlgorithms holds S3's checksum algorithms, by name.
+var checksumAlgorithms = map[string]*checksumAlgorithm{
+	ChecksumCRC32:  {name: ChecksumCRC32, newHash: func() hash.Hash { return crc32.NewIEEE() }},
+	ChecksumCRC32C: {name: ChecksumCRC32C, newHash: func() hash.Hash { return crc32.New(crc32cTable) }},
+	ChecksumSHA1:   {name: ChecksumSHA1, newHash: sha1.New},
+	ChecksumSHA256: {name: ChecksumSHA256, newHash: sha256.New},
+}
+
+// checksumVerifier sends the checksums of the requests of a single upload to
+// S3 and verifies the checksums S3 echoes back; see
+// WriterOptions.ChecksumSHA256, WriterOptions.ChecksumAlgorithm and
+// Options.SHA256Checksums.
+type checksumVerifier struct {
+	alg *checksumAlgorithm
+	// want is the base64-encoded checksum of the object, or empty if it is
+	// not known in advance, in which case the checksum of a single-part
+	// upload is computed from its body.
+	want string
+	// h hashes the content of a multipart upload as it is written.
+	h hash.Hash
+
+	mu sync.Mutex
+	// parts holds the base64-encoded checksum of each part of a multipart
+	// upload, by part number.
+	parts map[int64]string
+	// err is the first mismatch found.
+	err error
+}
+
+// newChecksumVerifier returns a checksumVerifier using alg for an upload
+// whose content has the checksum sum, or for any upload if sum is nil.
+func newChecksumVerifier(alg *checksumAlgorithm, sum []byte) *checksumVerifier {
+	return &checksumVerifier{
+		alg:   alg,
+		want:  base64.StdEncoding.EncodeToString(sum),
+		h:     alg.newHash(),
+		parts: map[int64]string{},
+	}
+}
+
+// requestOption returns a request option for the uploader of a writer that
+// adds checksums to its requests and checks those in S3's responses.
+func (v *checksumVerifier) requestOption() request.Option {
+	return func(r *request.Request) {
+		switch r.Operation.Name {
+		case "PutObject":
+			sum := v.want
+			r.Handlers.Build.PushBack(func(r *request.Request) {
+				if sum == "" {
+					var err error
+					if sum, err = v.bodyChecksum(r); err != nil {
+						r.Error = err
+						return
+					}
+				}
+				r.HTTPRequest.Header.Set(v.alg.header(), sum)
+			})
+			r.Handlers.Unmarshal.PushBack(func(r *request.Request) {
+				v.check(r, "object", sum, r.HTTPResponse.Header.Get(v.alg.header()))
+			})
+		case "CreateMultipartUpload":
+			r.Handlers.Build.PushBack(func(r *request.Request) {
+				r.HTTPRequest.Header.Set(checksumAlgorithmHeader, v.alg.name)
+			})
+		case "UploadPart":
+			var sum string
+			r.Handlers.Build.PushBack(func(r *request.Request) {
+				var err error
+				if sum, err = v.partChecksum(r); err != nil {
+					r.Error = err
+					return
+				}
+				r.HTTPRequest.Header.Set(v.alg.header(), sum)
+			})
+			r.Handlers.Unmarshal.PushBack(func(r *request.Request) {
+				n := aws.Int64Value(r.Params.(*s3.UploadPartInput).PartNumber)
+				v.check(r, fmt.Sprintf("part %d", n), sum, r.HTTPResponse.Header.Get(v.alg.header()))
+			})
+		case "CompleteMultipartUpload":
+			var want string
+			r.Handlers.Build.PushBack(func(r *request.Request) {
+				var err error
+				if want, err = v.completeBody(r); err != nil {
+					r.Error = err
+				}
+			})
+			var got string
+			// Read the checksum before the SDK consumes the body, but check
+			// it after the SDK has looked for an error in the body.
+			r.Handlers.Unmarshal.PushFront(func(r *request.Request) {
+				body, err := ioutil.ReadAll(r.HTTPResponse.Body)
+				r.HTTPResponse.Body.Close()
+				if err != nil {
+					r.Error = err
+					return
+				}
+				r.HTTPResponse.Body = ioutil.NopCloser(bytes.NewReader(body))
+				var out struct {
+					Elements []checksumElement `xml:",any"`
+				}
+				xml.Unmarshal(body, &out)
+				for _, e := range out.Elements {
+					if e.XMLName.Local == v.alg.element() {
+						got = e.Value
+					}
+				}
+			})
+			r.Handlers.Unmarshal.PushBack(func(r *request.Request) {
+				v.check(r, "object", want, got)
+			})
+		}
+	}
+}
+
+// checksumElement is an XML element holding a checksum, such as
+// <ChecksumSHA256>.
+type checksumElement struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// partChecksum returns the base64-encoded checksum of the body of r, an
+// UploadPart request, and records it for the CompleteMultipartUpload
+// request.
+func (v *checksumVerifier) partChecksum(r *request.Request) (string, error) {
+	sum, err := v.bodyChecksum(r)
+	if err != nil {
+		return "", err
+	}
+	v.mu.Lock()
+	v.parts[aws.Int64Value(r.Params.(*s3.UploadPartInput).PartNumber)] = sum
+	v.mu.Unlock()
+	return sum, nil
+}
+
+// bodyChecksum returns the base64-encoded checksum of the body of r.
+func (v *checksumVerifier) bodyChecksum(r *request.Request) (string, error) {
+	start, err := r.Body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	h := v.alg.newHash()
+	if _, err := io.Copy(h, r.Body); err != nil {
+		return "", err
+	}
+	if _, err := r.Body.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// completeBody replaces the body of r, a CompleteMultipartUpload request,
+// with one that includes the checksum of each part, which S3 requires for
+// uploads started with a checksum algorithm. It returns the checksum S3
+// should report for the object: per S3's composite checksums, the checksum
+// of the concatenated binary checksums of the parts, followed by "-" and
+// the number of parts.
+func (v *checksumVerifier) completeBody(r *request.Request) (string, error) {
+	type part struct {
+		Checksum   checksumElement
+		ETag       string
+		PartNumber int64
+	}
+	var body struct {
+		XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	h := v.alg.newHash()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, p := range r.Params.(*s3.CompleteMultipartUploadInput).MultipartUpload.Parts {
+		n := aws.Int64Value(p.PartNumber)
+		sum := v.parts[n]
+		b, err := base64.StdEncoding.DecodeString(sum)
+		if err != nil || len(b) != h.Size() {
+			return "", gcerr.Newf(gcerr.Internal, nil, "s3blob: no checksum for part %d", n)
+		}
+		h.Write(b)
+		body.Parts = append(body.Parts, part{
+			Checksum:   checksumElement{XMLName: xml.Name{Local: v.alg.element()}, Value: sum},
+			ETag:       aws.StringValue(p.ETag),
+			PartNumber: n,
+		})
+	}
+	b, err := xml.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	r.SetBufferBody(b)
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(h.Sum(nil)), len(body.Parts)), nil
+}
+
+// check fails r, and records the failure in v, if got, the checksum S3
+// returned for what (e.g. "object"), is not want.
+func (v *checksumVerifier) check(r *request.Request, what, want, got string) {
+	if r.Error != nil || got == want {
+		return
+	}
+	err := gcerr.Newf(gcerr.Internal, nil, "s3blob: S3 returned %s checksum %q for %s, want %q", v.alg.name, got, what, want)
+	if got == "" {
+		err = gcerr.Newf(gcerr.Internal, nil, "s3blob: S3 did not return the %s checksum of %s", v.alg.name, what)
+	}
+	r.Error = err
+	r.Retryable = aws.Bool(false)
+	v.mu.Lock()
+	if v.err == nil {
+		v.err = err
+	}
+	v.mu.Unlock()
+}
+
+// checkContent returns an error if the content written to a multipart
+// upload doesn't match the checksum given by the caller, if any.
+func (v *checksumVerifier) checkContent() error {
+	if v.want == "" {
+		return nil
+	}
+	if got := base64.StdEncoding.EncodeToString(v.h.Sum(nil)); got != v.want {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: content has SHA-256 checksum %q, but ChecksumSHA256 is %q", got, v.want)
+	}
+	return nil
+}
+
+// objectChecksum is the additional checksum of an object, as reported by
+// HeadObject; see ChecksumOf.
+type objectChecksum struct {
+	algorithm, value string
+}
+
+// requestOption is a request option for HeadObject and GetObject requests
+// that asks S3 for the object's checksum, which it only reports if asked,
+// and records it in c.
+func (c *objectChecksum) requestOption(r *request.Request) {
+	r.Handlers.Build.PushBack(func(r *request.Request) {
+		r.HTTPRequest.Header.Set(checksumModeHeader, "ENABLED")
+	})
+	r.Handlers.Unmarshal.PushBack(func(r *request.Request) {
+		for name, alg := range checksumAlgorithms {
+			if v := r.HTTPResponse.Header.Get(alg.header()); v != "" {
+				c.algorithm, c.value = name, v
+			}
+		}
+	})
+}
+
+// ChecksumOf returns the algorithm and the base64-encoded value of the
+// additional checksum S3 stores with the object with attrs, for a bucket
+// opened by this package, as set by WriterOptions.ChecksumAlgorithm,
+// WriterOptions.ChecksumSHA256 or Options.SHA256Checksums. For an object
+// uploaded in multiple parts, the checksum is a composite one: the checksum
+// of the concatenated checksums of the parts, followed by "-" and the
+// number of parts. It reports false if the object has no such checksum, or
+// if attrs weren't returned by Attributes with AttributesOptions.Checksum.
+func ChecksumOf(attrs blob.Attributes) (algorithm, checksum string, ok bool) {
+	var c objectChecksum
+	if !attrs.As(&c) || c.algorithm == "" {
+		return "", "", false
+	}
+	return c.algorithm, c.value, true
+}
+
+// checksumReader verifies the content of an object against its checksum as
+// it is read; see ReaderOptions.VerifyChecksum.
+type checksumReader struct {
+	io.ReadCloser
+	alg  *checksumAlgorithm
+	h    hash.Hash
+	want string
+}
+
+func newChecksumReader(body io.ReadCloser, alg *checksumAlgorithm, want string) *checksumReader {
+	return &checksumReader{ReadCloser: body, alg: alg, h: alg.newHash(), want: want}
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF {
+		if got := base64.StdEncoding.EncodeToString(r.h.Sum(nil)); got != r.want {
+			return n, gcerr.Newf(gcerr.Internal, nil, "s3blob: content read has %s checksum %q, but S3 reported %q", r.alg.name, got, r.want)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,336 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3blob
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// MultipartUpload is an S3 multipart upload that can be resumed, possibly by
+// another process, as long as the caller persists it. All of its fields are
+// exported so that it can be stored using encoding/json or similar.
+//
+// Use it instead of blob.Writer for very large uploads that must survive
+// restarts:
+//  - StartMultipartUpload begins the upload; persist the result.
+//  - UploadPart uploads each part and records it; persist the result after
+//    each call.
+//  - CompleteMultipartUpload assembles the object from the recorded parts.
+// If the persisted state is lost, ResumeMultipartUpload reconstructs it from
+// S3 given the key and UploadID. AbortMultipartUpload discards the upload
+// and its parts; S3 keeps (and bills for) the parts of an upload that is
+// neither completed nor aborted. ListIncompleteUploads and
+// AbortIncompleteUploads find and discard such uploads.
+//
+// See https://docs.aws.amazon.com/AmazonS3/latest/dev/mpuoverview.html.
+type MultipartUpload struct {
+	// Key is the key of the object being uploaded.
+	Key string
+	// UploadID is the ID assigned to the upload by S3.
+	UploadID string
+	// Parts are the parts uploaded so far, in increasing PartNumber order.
+	Parts []CompletedPart
+}
+
+// CompletedPart is a part of a MultipartUpload that has been uploaded.
+type CompletedPart struct {
+	// PartNumber is between 1 and 10000.
+	PartNumber int64
+	// ETag is the ETag returned by S3 for the part.
+	ETag string
+	// Size is the size of the part in bytes.
+	Size int64
+}
+
+// MultipartUploadOptions sets options for StartMultipartUpload.
+type MultipartUploadOptions struct {
+	// ContentType is the MIME type of the object. If empty,
+	// S3 uses "binary/octet-stream".
+	ContentType string
+	// Metadata holds key/value strings to be associated with the object.
+	// Keys are lowercased.
+	Metadata map[string]string
+}
+
+// StartMultipartUpload begins a multipart upload to key in bkt, which must
+// have been opened by this package. The bucket's WriteDefaults are applied
+// to the object, with opts.Metadata taking precedence. opts may be nil.
+func StartMultipartUpload(ctx context.Context, bkt *blob.Bucket, key string, opts *MultipartUploadOptions) (*MultipartUpload, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &MultipartUploadOptions{}
+	}
+	in := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(b.objectKey(key)),
+	}
+	if opts.ContentType != "" {
+		in.ContentType = aws.String(opts.ContentType)
+	}
+	wd := &b.opts.WriteDefaults
+	if in.Metadata, err = b.encodeMetadata(wd.metadata(opts.Metadata)); err != nil {
+		return nil, err
+	}
+	if wd.CacheControl != "" {
+		in.CacheControl = aws.String(wd.CacheControl)
+	}
+	if wd.ACL != "" {
+		in.ACL = aws.String(wd.ACL)
+	}
+	if wd.StorageClass != "" {
+		in.StorageClass = aws.String(wd.StorageClass)
+	}
+	if wd.ServerSideEncryption != "" {
+		in.ServerSideEncryption = aws.String(wd.ServerSideEncryption)
+	}
+	if wd.SSEKMSKeyID != "" {
+		in.SSEKMSKeyId = aws.String(wd.SSEKMSKeyID)
+	}
+	resp, err := b.client.CreateMultipartUploadWithContext(ctx, in)
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+	return &MultipartUpload{Key: key, UploadID: aws.StringValue(resp.UploadId)}, nil
+}
+
+// UploadPart uploads body as part number partNumber of u, and records it in
+// u.Parts, replacing any earlier upload of the same part. Part numbers must
+// be between 1 and 10000, and all parts except the last must be at least
+// 5 MiB. Parts may be uploaded in any order, but not concurrently for the
+// same u.
+func UploadPart(ctx context.Context, bkt *blob.Bucket, u *MultipartUpload, partNumber int64, body io.ReadSeeker) error {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return err
+	}
+	if partNumber < 1 || partNumber > int64(s3manager.MaxUploadParts) {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: part number %d must be between 1 and %d", partNumber, s3manager.MaxUploadParts)
+	}
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := b.client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(b.name),
+		Key:        aws.String(b.objectKey(u.Key)),
+		UploadId:   aws.String(u.UploadID),
+		PartNumber: aws.Int64(partNumber),
+		Body:       body,
+	})
+	if err != nil {
+		return b.wrapError(err)
+	}
+	u.addPart(CompletedPart{PartNumber: partNumber, ETag: aws.StringValue(resp.ETag), Size: size})
+	return nil
+}
+
+// addPart records p in u.Parts, keeping them sorted by PartNumber.
+func (u *MultipartUpload) addPart(p CompletedPart) {
+	i := sort.Search(len(u.Parts), func(i int) bool { return u.Parts[i].PartNumber >= p.PartNumber })
+	if i < len(u.Parts) && u.Parts[i].PartNumber == p.PartNumber {
+		u.Parts[i] = p
+		return
+	}
+	u.Parts = append(u.Parts, CompletedPart{})
+	copy(u.Parts[i+1:], u.Parts[i:])
+	u.Parts[i] = p
+}
+
+// CompleteMultipartUpload assembles the object from u.Parts. The parts must
+// be contiguous, starting from part 1.
+func CompleteMultipartUpload(ctx context.Context, bkt *blob.Bucket, u *MultipartUpload) error {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return err
+	}
+	if len(u.Parts) == 0 {
+		return gcerr.Newf(gcerr.FailedPrecondition, nil, "s3blob: multipart upload of %q has no parts", u.Key)
+	}
+	parts := make([]*s3.CompletedPart, len(u.Parts))
+	for i, p := range u.Parts {
+		if p.PartNumber != int64(i+1) {
+			return gcerr.Newf(gcerr.FailedPrecondition, nil, "s3blob: multipart upload of %q is missing part %d", u.Key, i+1)
+		}
+		parts[i] = &s3.CompletedPart{PartNumber: aws.Int64(p.PartNumber), ETag: aws.String(p.ETag)}
+	}
+	_, err = b.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.name),
+		Key:             aws.String(b.objectKey(u.Key)),
+		UploadId:        aws.String(u.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return b.wrapError(err)
+}
+
+// AbortMultipartUpload aborts u and deletes its uploaded parts.
+func AbortMultipartUpload(ctx context.Context, bkt *blob.Bucket, u *MultipartUpload) error {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(b.name),
+		Key:      aws.String(b.objectKey(u.Key)),
+		UploadId: aws.String(u.UploadID),
+	})
+	return b.wrapError(err)
+}
+
+// ResumeMultipartUpload returns the in-progress multipart upload to key with
+// the given uploadID, with Parts populated from the parts S3 has received.
+// If the upload has been completed or aborted, it returns an error for
+// which gcerrors.Code returns gcerrors.NotFound.
+func ResumeMultipartUpload(ctx context.Context, bkt *blob.Bucket, key, uploadID string) (*MultipartUpload, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return nil, err
+	}
+	u := &MultipartUpload{Key: key, UploadID: uploadID}
+	in := &s3.ListPartsInput{
+		Bucket:   aws.String(b.name),
+		Key:      aws.String(b.objectKey(key)),
+		UploadId: aws.String(uploadID),
+	}
+	err = b.client.ListPartsPagesWithContext(ctx, in, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			u.addPart(CompletedPart{
+				PartNumber: aws.Int64Value(p.PartNumber),
+				ETag:       aws.StringValue(p.ETag),
+				Size:       aws.Int64Value(p.Size),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+	return u, nil
+}
+
+// IncompleteUpload is a multipart upload that has been started but neither
+// completed nor aborted, such as one left behind by a process that crashed,
+// or by a blob.Writer with Options.LeavePartsOnError.
+type IncompleteUpload struct {
+	// Key is the key of the object being uploaded.
+	Key string
+	// UploadID is the ID assigned to the upload by S3.
+	UploadID string
+	// Initiated is when the upload was started.
+	Initiated time.Time
+}
+
+// ListIncompleteUploads returns the incomplete multipart uploads in bkt,
+// which must have been opened by this package, whose keys begin with
+// prefix, sorted by key and then by Initiated. Use ResumeMultipartUpload to
+// continue one of them, or AbortMultipartUpload to discard it.
+func ListIncompleteUploads(ctx context.Context, bkt *blob.Bucket, prefix string) ([]*IncompleteUpload, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return nil, err
+	}
+	return b.listIncompleteUploads(ctx, prefix)
+}
+
+func (b *bucket) listIncompleteUploads(ctx context.Context, prefix string) ([]*IncompleteUpload, error) {
+	prefix = b.normalizeKey(prefix)
+	in := &s3.ListMultipartUploadsInput{Bucket: aws.String(b.name)}
+	if b.opts.KeyHashPrefixLen == 0 && prefix != "" {
+		// With hashed keys, uploads with a common logical prefix are
+		// scattered, so the whole bucket is listed and filtered below.
+		in.Prefix = aws.String(prefix)
+	}
+	var uploads []*IncompleteUpload
+	err := b.client.ListMultipartUploadsPagesWithContext(ctx, in, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, u := range page.Uploads {
+			key, ok := b.logicalKey(aws.StringValue(u.Key))
+			if !ok || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			uploads = append(uploads, &IncompleteUpload{
+				Key:       key,
+				UploadID:  aws.StringValue(u.UploadId),
+				Initiated: aws.TimeValue(u.Initiated),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+	sort.SliceStable(uploads, func(i, j int) bool {
+		if uploads[i].Key != uploads[j].Key {
+			return uploads[i].Key < uploads[j].Key
+		}
+		return uploads[i].Initiated.Before(uploads[j].Initiated)
+	})
+	return uploads, nil
+}
+
+// AbortIncompleteUploads aborts the incomplete multipart uploads in bkt,
+// which must have been opened by this package, whose keys begin with prefix
+// and which were initiated before olderThan, and deletes their parts. It is
+// meant for periodic cleanup jobs; pass a time well in the past, such as a
+// day ago, so that uploads still in progress are not aborted. A lifecycle
+// rule with AbortIncompleteMultipartUpload does the same on S3's side.
+//
+// It returns the number of uploads aborted. Uploads that are completed or
+// aborted concurrently are skipped; other errors stop the cleanup.
+func AbortIncompleteUploads(ctx context.Context, bkt *blob.Bucket, prefix string, olderThan time.Time) (int, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return 0, err
+	}
+	uploads, err := b.listIncompleteUploads(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, u := range uploads {
+		if !u.Initiated.Before(olderThan) {
+			continue
+		}
+		_, err := b.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(b.name),
+			Key:      aws.String(b.hashKey(u.Key)),
+			UploadId: aws.String(u.UploadID),
+		})
+		if err != nil {
+			if b.ErrorCode(err) == gcerrors.NotFound {
+				continue
+			}
+			return n, b.wrapError(err)
+		}
+		n++
+	}
+	return n, nil
+}
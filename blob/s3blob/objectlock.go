@@ -0,0 +1,273 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3blob
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/internal/gcerr"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// LegalHold is the S3 Object Lock legal hold of an object.
+// See https://docs.aws.amazon.com/AmazonS3/latest/dev/object-lock-overview.html#object-lock-legal-holds.
+type LegalHold struct {
+	// LockEnabled is false if the bucket doesn't have Object Lock enabled,
+	// in which case objects can't have a legal hold.
+	LockEnabled bool
+	// On is true if the object has a legal hold, which prevents it from
+	// being deleted or overwritten until the hold is removed.
+	On bool
+}
+
+// Retention is the S3 Object Lock retention period of an object.
+// See https://docs.aws.amazon.com/AmazonS3/latest/dev/object-lock-overview.html#object-lock-retention-periods.
+type Retention struct {
+	// LockEnabled is false if the bucket doesn't have Object Lock enabled,
+	// in which case objects can't have a retention period.
+	LockEnabled bool
+	// Mode is the retention mode, s3.ObjectLockRetentionModeGovernance or
+	// s3.ObjectLockRetentionModeCompliance, or empty if the object has no
+	// retention period.
+	Mode string
+	// RetainUntil is the time until which the object is retained, or zero
+	// if it has no retention period.
+	RetainUntil time.Time
+}
+
+// ObjectLock is the Object Lock retention and legal hold of an object, as
+// set when it is written (see WriterOptions.ObjectLock) and as reported by
+// ObjectLockOf. The zero value means neither.
+type ObjectLock struct {
+	// Mode is the retention mode, s3.ObjectLockModeGovernance or
+	// s3.ObjectLockModeCompliance, or empty for no retention period.
+	Mode string
+	// RetainUntil is the time until which the object is retained. It is
+	// required with Mode, and when writing it must be in the future.
+	RetainUntil time.Time
+	// LegalHold is true if the object has a legal hold.
+	LegalHold bool
+}
+
+// validate checks l for a write.
+func (l *ObjectLock) validate() error {
+	switch l.Mode {
+	case "":
+		if !l.RetainUntil.IsZero() {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: ObjectLock.RetainUntil requires a Mode")
+		}
+		return nil
+	case s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance:
+	default:
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: ObjectLock.Mode must be %s or %s, got %q", s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance, l.Mode)
+	}
+	if !l.RetainUntil.After(time.Now()) {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: ObjectLock.RetainUntil must be in the future, got %v", l.RetainUntil)
+	}
+	return nil
+}
+
+// apply sets l on in.
+func (l *ObjectLock) apply(in *s3manager.UploadInput) {
+	if l.Mode != "" {
+		in.ObjectLockMode = aws.String(l.Mode)
+		in.ObjectLockRetainUntilDate = aws.Time(l.RetainUntil)
+	}
+	if l.LegalHold {
+		in.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+}
+
+// ObjectLockOf returns the Object Lock retention and legal hold of the object
+// with attrs, for a bucket opened by this package. S3 only reports them to
+// callers with the s3:GetObjectRetention and s3:GetObjectLegalHold
+// permissions, and not at all if the bucket doesn't have Object Lock
+// enabled; GetObjectRetention and GetObjectLegalHold tell these cases apart.
+func ObjectLockOf(attrs blob.Attributes) ObjectLock {
+	var head s3.HeadObjectOutput
+	if !attrs.As(&head) {
+		return ObjectLock{}
+	}
+	return ObjectLock{
+		Mode:        aws.StringValue(head.ObjectLockMode),
+		RetainUntil: aws.TimeValue(head.ObjectLockRetainUntilDate),
+		LegalHold:   aws.StringValue(head.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn,
+	}
+}
+
+// GetObjectLegalHold returns the legal hold of the object stored at key in
+// bkt, which must have been opened by this package. If the object doesn't
+// exist, it returns an error for which gcerrors.Code returns
+// gcerrors.NotFound.
+func GetObjectLegalHold(ctx context.Context, bkt *blob.Bucket, key string) (*LegalHold, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.GetObjectLegalHoldWithContext(ctx, &s3.GetObjectLegalHoldInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(b.objectKey(key)),
+	})
+	if err != nil {
+		if enabled, ok := objectLockUnset(err); ok {
+			return &LegalHold{LockEnabled: enabled}, nil
+		}
+		return nil, b.wrapError(err)
+	}
+	hold := &LegalHold{LockEnabled: true}
+	if resp.LegalHold != nil {
+		hold.On = aws.StringValue(resp.LegalHold.Status) == s3.ObjectLockLegalHoldStatusOn
+	}
+	return hold, nil
+}
+
+// SetObjectLegalHold places a legal hold on the object stored at key in bkt,
+// which must have been opened by this package, if on is true, or removes it
+// otherwise. If the bucket doesn't have Object Lock enabled, it returns an
+// error for which gcerrors.Code returns gcerrors.FailedPrecondition.
+func SetObjectLegalHold(ctx context.Context, bkt *blob.Bucket, key string, on bool) error {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return err
+	}
+	status := s3.ObjectLockLegalHoldStatusOff
+	if on {
+		status = s3.ObjectLockLegalHoldStatusOn
+	}
+	_, err = b.client.PutObjectLegalHoldWithContext(ctx, &s3.PutObjectLegalHoldInput{
+		Bucket:    aws.String(b.name),
+		Key:       aws.String(b.objectKey(key)),
+		LegalHold: &s3.ObjectLockLegalHold{Status: aws.String(status)},
+	})
+	if isObjectLockDisabled(err) {
+		return gcerr.Newf(gcerr.FailedPrecondition, err, "s3blob: bucket %q does not have Object Lock enabled", b.name)
+	}
+	return b.wrapError(err)
+}
+
+// GetObjectRetention returns the retention period of the object stored at
+// key in bkt, which must have been opened by this package. If the object
+// doesn't exist, it returns an error for which gcerrors.Code returns
+// gcerrors.NotFound.
+func GetObjectRetention(ctx context.Context, bkt *blob.Bucket, key string) (*Retention, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.GetObjectRetentionWithContext(ctx, &s3.GetObjectRetentionInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(b.objectKey(key)),
+	})
+	if err != nil {
+		if enabled, ok := objectLockUnset(err); ok {
+			return &Retention{LockEnabled: enabled}, nil
+		}
+		return nil, b.wrapError(err)
+	}
+	ret := &Retention{LockEnabled: true}
+	if resp.Retention != nil {
+		ret.Mode = aws.StringValue(resp.Retention.Mode)
+		ret.RetainUntil = aws.TimeValue(resp.Retention.RetainUntilDate)
+	}
+	return ret, nil
+}
+
+// RetentionOptions sets options for SetObjectRetention.
+type RetentionOptions struct {
+	// BypassGovernanceRetention allows the retention period of an object in
+	// GOVERNANCE mode to be shortened or removed, which requires the
+	// s3:BypassGovernanceRetention permission. It has no effect on objects
+	// in COMPLIANCE mode, whose retention period can only be extended.
+	BypassGovernanceRetention bool
+}
+
+// SetObjectRetention sets the retention period of the object stored at key
+// in bkt, which must have been opened by this package, to mode
+// (s3.ObjectLockRetentionModeGovernance or
+// s3.ObjectLockRetentionModeCompliance) until retainUntil. opts may be nil.
+//
+// If the object is in COMPLIANCE mode and the new retention period would
+// end earlier or be in GOVERNANCE mode, S3 rejects the request and
+// SetObjectRetention returns an error for which gcerrors.Code returns
+// gcerrors.FailedPrecondition. It also does so if the bucket doesn't have
+// Object Lock enabled.
+func SetObjectRetention(ctx context.Context, bkt *blob.Bucket, key, mode string, retainUntil time.Time, opts *RetentionOptions) error {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &RetentionOptions{}
+	}
+	if mode != s3.ObjectLockRetentionModeGovernance && mode != s3.ObjectLockRetentionModeCompliance {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: retention mode must be %s or %s, got %q", s3.ObjectLockRetentionModeGovernance, s3.ObjectLockRetentionModeCompliance, mode)
+	}
+	if retainUntil.IsZero() {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: retainUntil is required")
+	}
+	in := &s3.PutObjectRetentionInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(b.objectKey(key)),
+		Retention: &s3.ObjectLockRetention{
+			Mode:            aws.String(mode),
+			RetainUntilDate: aws.Time(retainUntil),
+		},
+	}
+	if opts.BypassGovernanceRetention {
+		in.BypassGovernanceRetention = aws.Bool(true)
+	}
+	_, err = b.client.PutObjectRetentionWithContext(ctx, in)
+	if isObjectLockDisabled(err) {
+		return gcerr.Newf(gcerr.FailedPrecondition, err, "s3blob: bucket %q does not have Object Lock enabled", b.name)
+	}
+	if err != nil && b.ErrorCode(err) == gcerr.PermissionDenied {
+		// S3 reports an attempt to shorten a COMPLIANCE retention period as
+		// access denied; check whether that is what happened.
+		if cur, gerr := GetObjectRetention(ctx, bkt, key); gerr == nil && cur.Mode == s3.ObjectLockRetentionModeCompliance &&
+			(mode != s3.ObjectLockRetentionModeCompliance || retainUntil.Before(cur.RetainUntil)) {
+			return gcerr.Newf(gcerr.FailedPrecondition, err, "s3blob: object %q is retained in COMPLIANCE mode until %v; its retention can only be extended", key, cur.RetainUntil)
+		}
+	}
+	return b.wrapError(err)
+}
+
+// objectLockUnset reports whether err, returned by a request for the legal
+// hold or retention of an object, means that it has none, and if so, whether
+// Object Lock is enabled for the bucket at all.
+func objectLockUnset(err error) (enabled, ok bool) {
+	if isObjectLockDisabled(err) {
+		return false, true
+	}
+	if e, ok := err.(awserr.Error); ok && e.Code() == "NoSuchObjectLockConfiguration" {
+		// Object Lock is enabled, but the object has no hold or retention.
+		return true, true
+	}
+	return false, false
+}
+
+// isObjectLockDisabled reports whether err is S3's error for an Object Lock
+// request on a bucket that doesn't have Object Lock enabled.
+func isObjectLockDisabled(err error) bool {
+	e, ok := err.(awserr.Error)
+	// "Bucket is missing Object Lock Configuration".
+	return ok && e.Code() == "InvalidRequest" && strings.Contains(e.Message(), "Object Lock")
+}
@@ -28,46 +28,115 @@
 //  - endpoint: The endpoint URL (hostname only or fully qualified URI); sets aws.Config.Endpoint.
 //  - disableSSL: A value of "true" disables SSL when sending requests; sets aws.Config.DisableSSL.
 //  - s3ForcePathStyle: A value of "true" forces the request to use path-style addressing; sets aws.Config.S3ForcePathStyle.
+//  - httpTimeout: The time limit for each HTTP request, as a duration like "30s"; sets the Timeout of
+//    aws.Config.HTTPClient. Use Options.HTTPClient for other HTTP settings.
+//  - sse: The server-side encryption of written objects, "AES256" or "aws:kms"; sets WriteDefaults.ServerSideEncryption.
+//  - kmsKeyID: The KMS key for "aws:kms" encryption; sets WriteDefaults.SSEKMSKeyID.
+//  - storageClass: The storage class of written objects, e.g. "STANDARD_IA"; sets WriteDefaults.StorageClass.
+//  - defaultACL: The canned ACL of written objects, e.g. "public-read"; sets WriteDefaults.ACL.
+//  - profile: The named profile in the shared credentials and config files to use
+//    instead of AWS_PROFILE; sets session.Options.Profile, and enables the shared config file.
+//    Credentials in environment variables still take precedence.
+//  - requesterPays: A value of "true" acknowledges that the caller pays for requests to a Requester Pays bucket;
+//    sets Options.RequesterPays.
+//  - useDualStack: A value of "true" makes requests use S3's dual-stack (IPv4 and IPv6) endpoint; sets Options.UseDualStack.
+//  - useAccelerate: A value of "true" makes requests use the S3 Transfer Acceleration endpoint; sets Options.UseAccelerate.
+//    It can't be combined with s3ForcePathStyle.
+//  - defaultPageSize: The number of objects requested per page when ListOptions.PageSize is zero;
+//    sets Options.DefaultPageSize.
+//  - maxRetries: The maximum number of times a request is retried after a transient error; sets Options.MaxRetries.
+//  - signedURLExpiry: How long signed URLs are valid for by default, as a duration like "15m";
+//    sets Options.SignedURLExpiry.
+//  - maxSignedURLExpiry: The longest validity accepted for signed URLs, as a duration like "24h";
+//    sets Options.MaxSignedURLExpiry.
+//  - assumeRole: The ARN of an IAM role, like "arn:aws:iam::123456789012:role/Reader", to assume with
+//    STS AssumeRole using the session's credentials; requests are signed with the role's temporary
+//    credentials, which are refreshed as they expire. Sets Options.Credentials.
+//  - externalID: The external ID the role's trust policy requires, if any; requires assumeRole.
+//  - sessionName: The name of the role session, e.g. for CloudTrail; requires assumeRole.
+//    By default a unique name is generated.
 // Example URL:
 //  s3://mybucket?region=us-east-1
 //
+// Metadata
+//
+// S3 stores user metadata as "x-amz-meta-" headers, whose names are
+// case-insensitive; S3 returns them in lowercase, and Go's HTTP client
+// canonicalizes them, so s3.HeadObjectOutput.Metadata has keys like
+// "User-Id". To make keys round-trip predictably, s3blob lowercases them
+// both when writing (including Options.WriteDefaults.Metadata) and in
+// Attributes: metadata written as {"User-Id": "1"} reads back as
+// {"user-id": "1"}. Use blob.Attributes.LookupMetadata to look keys up
+// case-insensitively. Keys that differ only in case collide.
+//
 // As
 //
 // s3blob exposes the following types for As:
 //  - Bucket: *s3.S3
-//  - Error: awserr.Error
-//  - ListObject: s3.Object for objects, s3.CommonPrefix for "directories"
-//  - ListOptions.BeforeList: *s3.ListObjectsV2Input
-//  - Reader: s3.GetObjectOutput
+//  - Error: awserr.Error, *MultipartInitiationError, *UploadFailedError, s3manager.MultiUploadFailure
+//  - ListObject: s3.Object for objects, s3.CommonPrefix for "directories";
+//    with Options.ListVersions, s3.ObjectVersion for versions and
+//    s3.DeleteMarkerEntry for delete markers instead of s3.Object
+//  - ListIterator.PageAs: s3.ListObjectsV2Output, or
+//    s3.ListObjectVersionsOutput with Options.ListVersions
+//  - ListOptions.BeforeList: *s3.ListObjectsV2Input, or
+//    *s3.ListObjectVersionsInput with Options.ListVersions
+//  - ReaderOptions.BeforeRead: *s3.GetObjectInput; zero-length reads send a
+//    HeadObject request built from it instead, since only the attributes are needed
+//  - Reader: s3.GetObjectOutput, with no Body or ContentRange for zero-length reads
+//  - AttributesOptions.BeforeAttributes: *s3.HeadObjectInput
 //  - Attributes: s3.HeadObjectOutput
 //  - WriterOptions.BeforeWrite: *s3manager.UploadInput
+//  - CopyOptions.BeforeCopy: *s3.CopyObjectInput, or *s3.CreateMultipartUploadInput
+//    for objects over 5 GB
 package s3blob // import "gocloud.dev/blob/s3blob"
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"mime"
 	"net/http"
 	"net/url"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"gocloud.dev/blob"
 	"gocloud.dev/blob/driver"
 	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
 	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// defaultPageSize is the default page size for ListPaged, and the most
+// objects S3 returns per page.
 const defaultPageSize = 1000
 
 func init() {
@@ -90,224 +159,1910 @@ func openURL(ctx context.Context, u *url.URL) (driver.Bucket, error) {
 	if s3ForcePathStyle := q["s3ForcePathStyle"]; len(s3ForcePathStyle) > 0 {
 		cfg.S3ForcePathStyle = aws.Bool(s3ForcePathStyle[0] == "true")
 	}
-	sess, err := session.NewSession(cfg)
+	if httpTimeout := q["httpTimeout"]; len(httpTimeout) > 0 {
+		d, err := time.ParseDuration(httpTimeout[0])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("s3blob: invalid httpTimeout %q", httpTimeout[0])
+		}
+		cfg.HTTPClient = &http.Client{Timeout: d}
+	}
+	opts := &Options{}
+	if sse := q["sse"]; len(sse) > 0 {
+		opts.WriteDefaults.ServerSideEncryption = sse[0]
+	}
+	if kmsKeyID := q["kmsKeyID"]; len(kmsKeyID) > 0 {
+		opts.WriteDefaults.SSEKMSKeyID = kmsKeyID[0]
+	}
+	if storageClass := q["storageClass"]; len(storageClass) > 0 {
+		opts.WriteDefaults.StorageClass = storageClass[0]
+	}
+	if acl := q["defaultACL"]; len(acl) > 0 {
+		opts.WriteDefaults.ACL = acl[0]
+	}
+	if requesterPays := q["requesterPays"]; len(requesterPays) > 0 {
+		opts.RequesterPays = requesterPays[0] == "true"
+	}
+	if useDualStack := q["useDualStack"]; len(useDualStack) > 0 {
+		opts.UseDualStack = useDualStack[0] == "true"
+	}
+	if useAccelerate := q["useAccelerate"]; len(useAccelerate) > 0 {
+		opts.UseAccelerate = useAccelerate[0] == "true"
+	}
+	if pageSize := q["defaultPageSize"]; len(pageSize) > 0 {
+		n, err := strconv.Atoi(pageSize[0])
+		if err != nil {
+			return nil, fmt.Errorf("s3blob: invalid defaultPageSize %q: %v", pageSize[0], err)
+		}
+		opts.DefaultPageSize = n
+	}
+	if expiry := q["signedURLExpiry"]; len(expiry) > 0 {
+		d, err := time.ParseDuration(expiry[0])
+		if err != nil {
+			return nil, fmt.Errorf("s3blob: invalid signedURLExpiry %q: %v", expiry[0], err)
+		}
+		opts.SignedURLExpiry = d
+	}
+	if expiry := q["maxSignedURLExpiry"]; len(expiry) > 0 {
+		d, err := time.ParseDuration(expiry[0])
+		if err != nil {
+			return nil, fmt.Errorf("s3blob: invalid maxSignedURLExpiry %q: %v", expiry[0], err)
+		}
+		opts.MaxSignedURLExpiry = d
+	}
+	if maxRetries := q["maxRetries"]; len(maxRetries) > 0 {
+		n, err := strconv.Atoi(maxRetries[0])
+		if err != nil {
+			return nil, fmt.Errorf("s3blob: invalid maxRetries %q: %v", maxRetries[0], err)
+		}
+		opts.MaxRetries = aws.Int(n)
+	}
+	var roleARN string
+	if assumeRole := q["assumeRole"]; len(assumeRole) > 0 {
+		roleARN = assumeRole[0]
+		if err := validateRoleARN(roleARN); err != nil {
+			return nil, fmt.Errorf("s3blob: invalid assumeRole %q: %v", roleARN, err)
+		}
+	}
+	var roleOpts []func(*stscreds.AssumeRoleProvider)
+	if externalID := q["externalID"]; len(externalID) > 0 {
+		roleOpts = append(roleOpts, func(p *stscreds.AssumeRoleProvider) { p.ExternalID = aws.String(externalID[0]) })
+	}
+	if sessionName := q["sessionName"]; len(sessionName) > 0 {
+		roleOpts = append(roleOpts, func(p *stscreds.AssumeRoleProvider) { p.RoleSessionName = sessionName[0] })
+	}
+	if roleARN == "" && len(roleOpts) > 0 {
+		return nil, errors.New("s3blob: externalID and sessionName require assumeRole")
+	}
+	sessOpts := session.Options{Config: *cfg}
+	if profile := q["profile"]; len(profile) > 0 {
+		sessOpts.Profile = profile[0]
+		sessOpts.SharedConfigState = session.SharedConfigEnable
+	}
+	sess, err := session.NewSessionWithOptions(sessOpts)
 	if err != nil {
 		return nil, err
 	}
-	return openBucket(ctx, sess, u.Host, nil)
+	if roleARN != "" {
+		opts.Credentials = stscreds.NewCredentials(sess, roleARN, roleOpts...)
+	}
+	return openBucket(ctx, sess, u.Host, opts)
 }
 
-// Options sets options for constructing a *blob.Bucket backed by fileblob.
-type Options struct{}
-
-// openBucket returns an S3 Bucket.
-func openBucket(ctx context.Context, sess client.ConfigProvider, bucketName string, _ *Options) (*bucket, error) {
-	if sess == nil {
-		return nil, errors.New("s3blob.OpenBucket: sess is required")
+// validateRoleARN returns an error unless s is the ARN of an IAM role, so that a
+// malformed assumeRole fails when the bucket is opened rather than on the
+// first request.
+func validateRoleARN(s string) error {
+	a, err := arn.Parse(s)
+	if err != nil {
+		return err
 	}
-	if bucketName == "" {
-		return nil, errors.New("s3blob.OpenBucket: bucketName is required")
+	if a.Service != "iam" || !strings.HasPrefix(a.Resource, "role/") || a.AccountID == "" {
+		return errors.New("not an IAM role ARN like arn:aws:iam::123456789012:role/name")
 	}
-	return &bucket{
-		name:   bucketName,
-		sess:   sess,
-		client: s3.New(sess),
-	}, nil
+	return nil
 }
 
-// OpenBucket returns a *blob.Bucket backed by S3. See the package documentation
-// for an example.
-func OpenBucket(ctx context.Context, sess client.ConfigProvider, bucketName string, opts *Options) (*blob.Bucket, error) {
-	drv, err := openBucket(ctx, sess, bucketName, opts)
-	if err != nil {
-		return nil, err
-	}
-	return blob.NewBucket(drv), nil
+// ACLBucketOwnerFullControl is the canned ACL that grants the bucket owner
+// full control over written objects. Use it as WriteDefaults.ACL when writing
+// to a bucket owned by another account.
+const ACLBucketOwnerFullControl = s3.ObjectCannedACLBucketOwnerFullControl
+
+// Options sets options for constructing a *blob.Bucket backed by S3.
+type Options struct {
+	// DecodeMultipartETags controls how the ETags of objects uploaded in
+	// multiple parts are reported as MD5s. By default they are not: their
+	// ETag ("<hex>-<number of parts>") is a hash of the parts' hashes rather
+	// than of the content, so MD5 is nil. If true, the hex portion is decoded
+	// and reported as MD5 anyway; this is only useful with backends or tools
+	// that understand that composite hash.
+	// The raw ETag is always available as Attributes.ETag.
+	DecodeMultipartETags bool
+
+	// EncodeMetadata, if true, encodes user metadata values that contain
+	// non-ASCII characters as RFC 2047 encoded-words ("=?utf-8?q?...?="),
+	// which is how S3 itself returns such values, and decodes encoded
+	// values in Attributes, so that they round-trip. Without it, writing
+	// such a value fails with an error for which gcerrors.Code returns
+	// gcerrors.InvalidArgument, since the AWS SDK can't sign it. Other
+	// tools see the encoded form. Keys must always be ASCII.
+	EncodeMetadata bool
+
+	// Credentials, if not nil, are used to sign requests instead of the
+	// session's credentials. Use credentials.NewCredentials to plug in any
+	// credentials.Provider, e.g. one backed by a secrets manager.
+	Credentials *credentials.Credentials
+
+	// RoleARN and WebIdentityTokenFile, if set, make requests use temporary
+	// credentials for the IAM role RoleARN, obtained from STS
+	// AssumeRoleWithWebIdentity with the OIDC token in the file
+	// WebIdentityTokenFile, instead of the session's credentials. This is
+	// how IAM roles for service accounts (IRSA) work on EKS, which mounts
+	// the token into pods and sets AWS_ROLE_ARN and
+	// AWS_WEB_IDENTITY_TOKEN_FILE; the version of the AWS SDK used by this
+	// package doesn't pick those up by itself. Setting the fields explicitly
+	// also lets buckets opened in one process assume different roles. The
+	// token file is read again whenever the credentials are refreshed, since
+	// it is rotated. RoleSessionName, if not empty, names the role session,
+	// e.g. for CloudTrail; by default a unique name is generated.
+	// They can't be combined with Credentials.
+	RoleARN              string
+	WebIdentityTokenFile string
+	RoleSessionName      string
+
+	// CreateDirMarkers, if true, makes sure that a zero-length "directory
+	// marker" object exists for each ancestor "directory" of a written key,
+	// so that UIs which expect them (like the S3 console) show the
+	// directories even when they have no other objects in them. For example,
+	// writing "a/b/c.txt" creates "a/" and "a/b/" unless they already exist.
+	// This costs a HeadObject request per ancestor, plus a PutObject request
+	// for each missing marker, after every successful write.
+	CreateDirMarkers bool
+
+	// SHA256Metadata, if true, stores the hex-encoded SHA-256 of the content
+	// of every object written through the bucket in its user metadata under
+	// SHA256MetadataKey, as an integrity check that is independent of S3's
+	// ETag. It is returned in Attributes.Metadata.
+	//
+	// Metadata has to be sent before the content, so the writer buffers the
+	// entire object in memory in order to hash it first, and writes of more
+	// than SHA256MetadataMaxSize bytes fail. Leave this off for large objects.
+	SHA256Metadata bool
+
+	// DetectContentType, if true, makes writers whose content type is
+	// "application/octet-stream" (or "binary/octet-stream") after
+	// WriterOptions.BeforeWrite detect it from the first 512 bytes of the
+	// content with http.DetectContentType, so that objects written by
+	// callers that don't know their type, such as proxies, are served with
+	// a useful Content-Type. blob.Bucket.NewWriter already does this when
+	// WriterOptions.ContentType is empty. The writer buffers at least 512
+	// bytes before it starts uploading anyway, so this doesn't affect
+	// streaming.
+	DetectContentType bool
+
+	// SHA256Checksums, if true, makes writers send the SHA-256 of every
+	// request body to S3, which rejects the request if the body it received
+	// doesn't match, and check the checksum S3 returns, failing with an
+	// error for which gcerrors.Code returns gcerrors.Internal on a mismatch.
+	// This protects large objects end to end without buffering them: a
+	// streaming write is uploaded in parts, each hashed from the in-memory
+	// part the uploader sends, and the object's checksum is S3's composite
+	// checksum, the SHA-256 of the parts' checksums (see
+	// WriterOptions.ChecksumSHA256). Unlike SHA256Metadata, no hash of the
+	// whole content is computed or stored; S3 keeps the checksum with the
+	// object instead. Use WriterOptions.ChecksumSHA256 to also check the
+	// content against a checksum known in advance.
+	SHA256Checksums bool
+
+	// NormalizeKeys, if true, trims a single leading "/" from keys and list
+	// prefixes in all operations, so that "/a/b" and "a/b" address the same
+	// object. By default keys are used exactly as given, and S3 treats a
+	// leading "/" as part of the key (if the session sets
+	// aws.Config.DisableRestProtocolURICleaning; otherwise the AWS SDK
+	// cleans request paths itself).
+	NormalizeKeys bool
+
+	// CollapseSlashes, if true along with NormalizeKeys, also replaces each
+	// run of "/" in keys with a single "/", so that "a//b" addresses "a/b".
+	CollapseSlashes bool
+
+	// DecompressionMetadataKey, if not empty, is a user metadata key that
+	// marks objects as compressed, independently of Content-Encoding. When an
+	// object is read whose metadata has this key (compared case-insensitively,
+	// e.g. "compressed=zstd"), its content is decompressed with the matching
+	// entry in Decompressors, or with gzip for "gzip". Reading an unknown
+	// algorithm fails. The metadata is part of the GET response, so this
+	// doesn't cost an extra request.
+	//
+	// Only whole objects can be decompressed; range reads of compressed
+	// objects fail with gcerrors.InvalidArgument. Reader.Size reports the
+	// size of the decompressed content, which must be stored in the
+	// object's metadata under UncompressedSizeMetadataKey when it is
+	// written; reading a compressed object without it fails with
+	// gcerrors.FailedPrecondition.
+	DecompressionMetadataKey string
+
+	// Decompressors maps compression algorithm names found under
+	// DecompressionMetadataKey to decompressors for them, in addition to
+	// the built-in "gzip". For example, to support zstd using
+	// github.com/klauspost/compress/zstd:
+	//  Decompressors: map[string]s3blob.Decompressor{
+	//    "zstd": func(r io.Reader) (io.ReadCloser, error) {
+	//      d, err := zstd.NewReader(r)
+	//      if err != nil {
+	//        return nil, err
+	//      }
+	//      return d.IOReadCloser(), nil
+	//    },
+	//  }
+	Decompressors map[string]Decompressor
+
+	// MaxConcurrentOps, if positive, limits the number of S3 requests made
+	// through the bucket that can be in flight at once, including those made
+	// by readers, writers and the package-level functions. A request counts
+	// until its response body has been closed, so an open Reader holds on to
+	// its slot until it is closed. When the limit is reached, further
+	// requests block until a slot is free or their context is done.
+	MaxConcurrentOps int
+
+	// ExpectedBucketOwner, if not empty, is the AWS account ID that must own
+	// the bucket. It is sent with every request, including all the requests
+	// of a write, so that if the bucket is owned by a different account
+	// (for example, because it was deleted and recreated by someone else),
+	// requests fail with gcerrors.PermissionDenied instead of reading from
+	// or writing to the wrong account's bucket.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/dev/bucket-owner-condition.html.
+	ExpectedBucketOwner string
+
+	// RequesterPays, if true, sends "x-amz-request-payer: requester" with
+	// every request, acknowledging that the caller's account pays for
+	// requests to and transfers from a bucket with Requester Pays enabled.
+	// Without it, reads and lists in such buckets fail with
+	// gcerrors.PermissionDenied. Signed URLs include the header in their
+	// signature, so their users must send it too.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/dev/RequesterPaysBuckets.html.
+	RequesterPays bool
+
+	// KeyHashPrefixLen, if positive, stores each object under a prefix of
+	// that many hex digits of the MD5 of its key, followed by "/"; for
+	// example, with KeyHashPrefixLen 4, "a/b" is stored as "4d1b/a/b".
+	// Callers keep using the logical key ("a/b") everywhere, and keys
+	// returned by List are rebased to logical keys. It must be at most 32.
+	//
+	// This spreads writes across S3's index partitions, which used to matter
+	// for very high request rates. S3 now partitions automatically and
+	// supports thousands of requests per second per prefix, so most
+	// workloads don't need it, and it has significant costs:
+	//  - List has to scan the entire bucket, since objects with a common
+	//    logical prefix are scattered, and results are not sorted by
+	//    logical key.
+	//  - ListOptions.Delimiter is not supported.
+	//  - Other tools see the hashed keys.
+	// It must not be changed for an existing bucket.
+	KeyHashPrefixLen int
+
+	// MultipartThreshold, if positive, is the size above which objects are
+	// uploaded in multiple parts. Objects up to this size are buffered in
+	// memory and uploaded with a single PutObject request, so that their
+	// ETag is the MD5 of their content. By default the threshold is the part
+	// size (MinPartSize, WriterOptions.BufferSize, or
+	// s3manager.DefaultUploadPartSize), which also applies if it is larger
+	// than MultipartThreshold.
+	// It must be at least s3manager.MinUploadPartSize and at most 5 GiB,
+	// the largest object PutObject accepts.
+	MultipartThreshold int64
+
+	// MinPartSize, if positive, is the size of the parts of multipart
+	// uploads, instead of WriterOptions.BufferSize, which is then ignored,
+	// so that the part size and MultipartThreshold can be tuned
+	// independently of the buffer size callers ask for: larger parts use
+	// more memory per upload, smaller ones more requests. Parts are larger
+	// when needed to keep an upload of known size within S3's 10,000 parts.
+	// It must be at least s3manager.MinUploadPartSize (5 MiB), the smallest
+	// part S3 accepts, and at most 5 GiB.
+	MinPartSize int64
+
+	// UploadConcurrency, if positive, is the number of parts of a multipart
+	// upload that a writer uploads in parallel, which can speed up writes
+	// over high-bandwidth links at the cost of more memory: each part in
+	// flight is buffered. If zero, s3manager.DefaultUploadConcurrency is used.
+	// It must not be negative.
+	UploadConcurrency int
+
+	// LeavePartsOnError, if true, leaves the parts of a multipart upload
+	// that fails in S3 instead of aborting it, so that they can be
+	// recovered; the upload ID is available from the writer's error via
+	// s3manager.MultiUploadFailure. Left parts are billed until they are
+	// removed with AbortMultipartUpload, AbortIncompleteUploads or a
+	// lifecycle rule. By default, a failed upload is aborted.
+	LeavePartsOnError bool
+
+	// DisableContentMD5Validation sets aws.Config.S3DisableContentMD5Validation
+	// for the bucket's client, for S3-compatible backends that reject the
+	// checksum headers the AWS SDK adds automatically. It affects exactly
+	// the PutObject and UploadPart requests made by writers and UploadPart,
+	// for which the SDK otherwise computes the Content-MD5 and
+	// X-Amz-Content-Sha256 headers from the body; the SDK then still sends
+	// X-Amz-Content-Sha256 for signing. It does not affect ContentMD5 set
+	// via WriterOptions, nor the Content-MD5 header that S3 requires for
+	// operations like DeleteObjects. The SDK currently doesn't validate
+	// GetObject responses either way.
+	DisableContentMD5Validation bool
+
+	// UseDualStack, if true, sets aws.Config.UseDualStack for the bucket's
+	// client, so that requests go to S3's dual-stack endpoint for the region
+	// (s3.dualstack.<region>.amazonaws.com), which supports both IPv4 and
+	// IPv6. It has no effect if the session has a custom aws.Config.Endpoint,
+	// which takes precedence.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/dev/dual-stack-endpoints.html.
+	UseDualStack bool
+
+	// UseAccelerate, if true, sets aws.Config.S3UseAccelerate for the
+	// bucket's client, so that reads and writes go through the S3 Transfer
+	// Acceleration endpoint (<bucket>.s3-accelerate.amazonaws.com, or
+	// s3-accelerate.dualstack with UseDualStack). Transfer Acceleration must
+	// be enabled on the bucket, and its name must be DNS-compatible. It is
+	// incompatible with path-style addressing, so OpenBucket fails if the
+	// session has aws.Config.S3ForcePathStyle set.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/dev/transfer-acceleration.html.
+	UseAccelerate bool
+
+	// MaxRetries, if not nil, sets aws.Config.MaxRetries for the bucket's
+	// client: the number of times a request that failed with a transient
+	// error, such as throttling, is retried with exponential backoff. If nil,
+	// the session's setting is used. It must not be negative.
+	MaxRetries *int
+
+	// HTTPClient, if not nil, sets aws.Config.HTTPClient for the bucket's
+	// client, for example to configure TLS, proxies, timeouts or connection
+	// pooling for S3 traffic. If nil, the session's client is used.
+	// MaxConcurrentOps applies on top of it.
+	HTTPClient *http.Client
+
+	// OnUpload, if not nil, is called after each successful write through
+	// the bucket with information about how the object was uploaded, e.g.
+	// to record metrics on how often uploads use multiple parts. It must be
+	// safe for concurrent use.
+	OnUpload func(UploadInfo)
+
+	// CorrectClockSkew, if true, makes the bucket adjust the time it signs
+	// requests with when S3 rejects a request with RequestTimeTooSkewed
+	// because the local clock is off, using the Date header of S3's response
+	// as the correct time. The failed request is retried (subject to the
+	// session's aws.Config.MaxRetries), and later requests are signed with
+	// the corrected time. XAmzContentSHA256Mismatch errors, which proxies
+	// that rewrite requests can cause, are retried too.
+	//
+	// Regardless of this option, both errors have the code
+	// gcerrors.Unavailable.
+	CorrectClockSkew bool
+
+	// WriteDefaults is the write policy of the bucket, applied to every
+	// object written through it.
+	WriteDefaults WriteDefaults
+
+	// InitiateMultipartRetries, if positive, is the number of times writers
+	// retry the CreateMultipartUpload request that starts a multipart upload
+	// after a transient error (such as a 5xx response, throttling or a
+	// connection error), with exponential backoff, instead of the session's
+	// aws.Config.MaxRetries. Retrying it is safe, since no upload exists
+	// until it succeeds, and cheap, since no content has been sent yet.
+	//
+	// Regardless of this option, if a write fails because the multipart
+	// upload could not be started, the error is a *MultipartInitiationError;
+	// if it fails while uploading parts, it is an s3manager.MultiUploadFailure.
+	// Both are available through blob.Bucket.ErrorAs.
+	InitiateMultipartRetries int
+
+	// WriteRetry, if not nil, makes the requests that upload objects
+	// (PutObject, and CreateMultipartUpload, UploadPart and
+	// CompleteMultipartUpload for multipart uploads) retry when S3 throttles
+	// them with a SlowDown error, with jittered exponential backoff, in
+	// addition to the session's retries for other errors. Each request is
+	// retried on its own, so a throttled part doesn't restart the upload.
+	WriteRetry *WriteRetryConfig
+
+	// DefaultPageSize, if positive, is the number of objects requested per
+	// page (S3's max-keys) by listings that don't ask for a page size, such
+	// as blob.Bucket.List, instead of 1000. Smaller pages use less memory,
+	// at the cost of more requests. Values above 1000, the most S3 returns
+	// per page, are reduced to 1000. A page size requested by the caller,
+	// e.g. by blob.Bucket.ListN, takes precedence.
+	DefaultPageSize int
+
+	// SkipDeleteExistenceCheck, if true, makes Delete send DeleteObject
+	// directly, without first checking that the object exists with a
+	// HeadObject request. This halves the number of requests and the
+	// latency of each delete, but since S3 reports success for deleting a
+	// missing object, Delete then returns nil instead of a NotFound error
+	// for missing keys, which differs from the documented behavior of
+	// blob.Bucket.Delete. Leave it off if callers rely on that error.
+	SkipDeleteExistenceCheck bool
+
+	// CreateBucketIfMissing, if true, makes writes that fail because the
+	// bucket doesn't exist (NoSuchBucket) create it, in the region of the
+	// bucket's client, and then retry the failed request once. It is meant
+	// for ephemeral buckets, such as those of test environments; leave it
+	// off in production, where a missing bucket usually means a
+	// misconfiguration that should fail loudly. The bucket is created with
+	// S3's defaults, and only PutObject and CreateMultipartUpload requests
+	// are retried, so other operations on a missing bucket still fail.
+	CreateBucketIfMissing bool
+
+	// CheckBucketExists, if true, makes OpenBucket check that the bucket
+	// exists, with a HeadBucket request, so that a misconfigured bucket name
+	// fails fast rather than on the first operation. If it doesn't exist,
+	// OpenBucket returns an error for which gcerrors.Code returns
+	// gcerrors.NotFound. It is ignored with CreateBucketIfMissing.
+	// See also BucketExists.
+	CheckBucketExists bool
+
+	// DirectoryPrefixes, if true, makes listings treat a non-empty
+	// ListOptions.Prefix as a directory: if it doesn't end with the
+	// delimiter (or "/", if ListOptions.Delimiter is empty), one is
+	// appended, so that listing "a/b" returns "a/b/c" but not "a/bar" or
+	// "a/b" itself. See ListPaged for the default behavior.
+	DirectoryPrefixes bool
+
+	// ListVersions, if true, makes listings return every version of every
+	// object in a bucket with versioning enabled, including delete markers,
+	// instead of only the latest versions. Objects are listed in key order,
+	// and the versions of each key from newest to oldest. Use ListObject.As
+	// with s3.ObjectVersion or s3.DeleteMarkerEntry to get the VersionId and
+	// IsLatest of each entry; a delete marker has a Size of 0 and no MD5.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketGETVersion.html.
+	ListVersions bool
+
+	// SignedURLExpiry, if positive, is how long URLs returned by
+	// blob.Bucket.SignedURL are valid for when SignedURLOptions.Expiry is
+	// zero, instead of blob.DefaultSignedURLExpiry (or MaxSignedURLExpiry,
+	// if that is shorter). It can't exceed MaxSignedURLExpiry.
+	SignedURLExpiry time.Duration
+
+	// MaxSignedURLExpiry, if positive, is the longest SignedURLOptions.Expiry
+	// that SignedURL accepts; longer ones are rejected with an error for
+	// which gcerrors.Code returns gcerrors.InvalidArgument. It can't exceed,
+	// and defaults to, MaxPresignExpiry, the longest S3 accepts.
+	MaxSignedURLExpiry time.Duration
 }
 
-// reader reads an S3 object. It implements io.ReadCloser.
-type reader struct {
-	body  io.ReadCloser
-	attrs driver.ReaderAttributes
-	raw   *s3.GetObjectOutput
+// MaxPresignExpiry is the longest time for which S3 accepts a URL presigned
+// with Signature Version 4: URLs signed for longer are rejected when used.
+const MaxPresignExpiry = 7 * 24 * time.Hour
+
+// MultipartInitiationError is the error of a write that failed because its
+// multipart upload could not be started; see
+// Options.InitiateMultipartRetries. No part of the object was uploaded.
+type MultipartInitiationError struct {
+	// Err is the error of the CreateMultipartUpload request.
+	Err error
 }
 
-func (r *reader) Read(p []byte) (int, error) {
-	return r.body.Read(p)
+func (e *MultipartInitiationError) Error() string {
+	return "s3blob: starting multipart upload: " + e.Err.Error()
 }
 
-// Close closes the reader itself. It must be called when done reading.
-func (r *reader) Close() error {
-	return r.body.Close()
+// Unwrap returns e.Err.
+func (e *MultipartInitiationError) Unwrap() error {
+	return e.Err
 }
 
-func (r *reader) As(i interface{}) bool {
-	p, ok := i.(*s3.GetObjectOutput)
-	if !ok {
-		return false
-	}
-	*p = *r.raw
-	return true
+// UploadFailedError is the error returned by Write once the upload of a
+// writer that streams its content to S3 has failed, for example because a
+// part could not be uploaded. Every later Write returns the same error, and
+// Close returns Err. gcerrors.Code and blob.Bucket.ErrorAs look through it
+// to Err.
+type UploadFailedError struct {
+	// Err is the error of the upload.
+	Err error
 }
 
-func (r *reader) Attributes() driver.ReaderAttributes {
-	return r.attrs
+func (e *UploadFailedError) Error() string {
+	return "s3blob: write after upload failed: " + e.Err.Error()
 }
 
-// writer writes an S3 object, it implements io.WriteCloser.
-type writer struct {
-	w *io.PipeWriter // created when the first byte is written
+// Unwrap returns e.Err.
+func (e *UploadFailedError) Unwrap() error {
+	return e.Err
+}
 
-	ctx      context.Context
-	uploader *s3manager.Uploader
-	req      *s3manager.UploadInput
-	donec    chan struct{} // closed when done writing
-	// The following fields will be written before donec closes:
-	err error
+// WriteDefaults holds bucket-wide defaults for writes; see
+// Options.WriteDefaults. Empty fields have no effect.
+//
+// Per-write options take precedence: WriterOptions.CacheControl over
+// CacheControl, WriterOptions.Metadata over Metadata for the same key, and
+// fields set on the *s3manager.UploadInput in WriterOptions.BeforeWrite over
+// the others. StartMultipartUpload and Copy apply them in the same way,
+// except that Copy only applies StorageClass, ServerSideEncryption,
+// SSEKMSKeyID and ACL.
+type WriteDefaults struct {
+	// StorageClass is the storage class of written objects. If empty, S3
+	// uses STANDARD. It must be one of STANDARD, REDUCED_REDUNDANCY,
+	// STANDARD_IA, ONEZONE_IA, INTELLIGENT_TIERING or GLACIER. Not every
+	// class is available in every region or from every S3-compatible
+	// backend; S3 reports those errors when writing.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/dev/storage-class-intro.html.
+	StorageClass string
+
+	// ServerSideEncryption is the server-side encryption of written objects:
+	// s3.ServerSideEncryptionAes256 (SSE-S3) or s3.ServerSideEncryptionAwsKms
+	// (SSE-KMS). If empty, the bucket's default encryption applies.
+	// The encryption of an existing object is reported in the
+	// ServerSideEncryption and SSEKMSKeyId fields of the s3.HeadObjectOutput
+	// and s3.GetObjectOutput exposed by Attributes.As and Reader.As.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/dev/serv-side-encryption.html.
+	ServerSideEncryption string
+
+	// SSEKMSKeyID is the ID or ARN of the KMS key used with SSE-KMS. It
+	// requires ServerSideEncryption s3.ServerSideEncryptionAwsKms. It may be
+	// empty, in which case S3 uses the account's AWS-managed key for S3
+	// ("aws/s3"), so that SSE-KMS can be used without managing keys.
+	SSEKMSKeyID string
+
+	// ACL is the canned ACL of written objects, for example
+	// ACLBucketOwnerFullControl for cross-account uploads. If empty, no ACL
+	// is sent and S3 applies its default. It must be one of private,
+	// public-read, public-read-write, authenticated-read, aws-exec-read,
+	// bucket-owner-read or bucket-owner-full-control.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/dev/acl-overview.html#canned-acl.
+	ACL string
+
+	// CacheControl is the Cache-Control of written objects.
+	CacheControl string
+
+	// Metadata is user metadata added to written objects. Keys are
+	// lowercased, as for WriterOptions.Metadata.
+	Metadata map[string]string
 }
 
-// Write appends p to w. User must call Close to close the w after done writing.
-func (w *writer) Write(p []byte) (int, error) {
-	// Avoid opening the pipe for a zero-length write;
-	// the concrete can do these for empty blobs.
-	if len(p) == 0 {
-		return 0, nil
+// validate returns an error if d is not valid.
+func (d *WriteDefaults) validate() error {
+	if err := validateStorageClass(d.StorageClass); err != nil {
+		return err
 	}
-	if w.w == nil {
-		// We'll write into pw and use pr as an io.Reader for the
-		// Upload call to S3.
-		pr, pw := io.Pipe()
-		w.w = pw
-		if err := w.open(pr); err != nil {
-			return 0, err
-		}
+	if err := validateACL(d.ACL); err != nil {
+		return err
 	}
-	select {
-	case <-w.donec:
-		return 0, w.err
+	switch d.ServerSideEncryption {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
 	default:
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: unsupported server-side encryption %q; must be %s or %s", d.ServerSideEncryption, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
 	}
-	return w.w.Write(p)
+	if d.SSEKMSKeyID != "" && d.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: SSEKMSKeyID requires ServerSideEncryption %s", s3.ServerSideEncryptionAwsKms)
+	}
+	return nil
 }
 
-// pr may be nil if we're Closing and no data was written.
-func (w *writer) open(pr *io.PipeReader) error {
-
-	go func() {
-		defer close(w.donec)
+// metadata returns the user metadata to write: md merged over d.Metadata,
+// with lowercase keys.
+func (d *WriteDefaults) metadata(md map[string]string) map[string]*string {
+	if len(md) == 0 && len(d.Metadata) == 0 {
+		return nil
+	}
+	merged := make(map[string]*string, len(md)+len(d.Metadata))
+	for k, v := range d.Metadata {
+		merged[strings.ToLower(k)] = aws.String(v)
+	}
+	for k, v := range md {
+		merged[strings.ToLower(k)] = aws.String(v)
+	}
+	return merged
+}
 
-		if pr == nil {
-			// AWS doesn't like a nil Body.
-			w.req.Body = http.NoBody
-		} else {
-			w.req.Body = pr
+// encodeMetadata returns md, user metadata to write, after checking that
+// its keys and values can be sent as HTTP headers, with non-ASCII values
+// encoded if Options.EncodeMetadata is set. md itself is not modified.
+func (b *bucket) encodeMetadata(md map[string]*string) (map[string]*string, error) {
+	var encoded map[string]*string
+	for k, v := range md {
+		if k == "" || strings.IndexFunc(k, func(r rune) bool { return !isTokenChar(r) }) >= 0 {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: invalid metadata key %q: keys may only contain ASCII letters, digits and !#$%%&'*+-.^_`|~", k)
 		}
-		_, err := w.uploader.UploadWithContext(w.ctx, w.req)
-		if err != nil {
-			w.err = err
-			if pr != nil {
-				pr.CloseWithError(err)
+		val := aws.StringValue(v)
+		ascii := true
+		for _, r := range val {
+			if r < ' ' && r != '\t' || r == 0x7f {
+				return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: metadata value for key %q contains control character %q", k, r)
+			}
+			if r > 0x7f {
+				ascii = false
 			}
-			return
 		}
-	}()
-	return nil
+		if ascii {
+			continue
+		}
+		if !b.opts.EncodeMetadata {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: metadata value for key %q contains non-ASCII characters; set Options.EncodeMetadata to encode it", k)
+		}
+		if encoded == nil {
+			encoded = make(map[string]*string, len(md))
+			for k, v := range md {
+				encoded[k] = v
+			}
+		}
+		encoded[k] = aws.String(mime.QEncoding.Encode("utf-8", val))
+	}
+	if encoded == nil {
+		return md, nil
+	}
+	return encoded, nil
 }
 
-// Close completes the writer and close it. Any error occuring during write will
-// be returned. If a writer is closed before any Write is called, Close will
-// create an empty file at the given key.
-func (w *writer) Close() error {
-	if w.w == nil {
-		// We never got any bytes written. We'll write an http.NoBody.
-		w.open(nil)
-	} else if err := w.w.Close(); err != nil {
-		return err
+// isTokenChar reports whether r may appear in an HTTP header name.
+func isTokenChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
 	}
-	<-w.donec
-	return w.err
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
 }
 
-// bucket represents an S3 bucket and handles read, write and delete operations.
-type bucket struct {
-	name   string
-	sess   client.ConfigProvider
-	client *s3.S3
+// decodeMetadataValue decodes v, a user metadata value read from S3, if
+// Options.EncodeMetadata is set; see encodeMetadata.
+func (b *bucket) decodeMetadataValue(v string) string {
+	if !b.opts.EncodeMetadata {
+		return v
+	}
+	if d, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+		return d
+	}
+	return v
 }
 
-func (b *bucket) ErrorCode(err error) gcerrors.ErrorCode {
-	e, ok := err.(awserr.Error)
+// clockSkew is the difference between S3's clock and the local clock; see
+// Options.CorrectClockSkew.
+type clockSkew struct {
+	offset int64 // a time.Duration; accessed atomically
+}
+
+// now returns the current time according to S3.
+func (c *clockSkew) now() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&c.offset)))
+}
+
+// retryHandler is an AWS SDK Retry handler that corrects c when a request
+// failed because of clock skew, and makes the request retryable.
+func (c *clockSkew) retryHandler(r *request.Request) {
+	e, ok := r.Error.(awserr.Error)
 	if !ok {
-		return gcerrors.Unknown
+		return
 	}
-	switch {
-	case e.Code() == "NoSuchKey" || e.Code() == "NotFound":
-		return gcerrors.NotFound
-	default:
-		return gcerrors.Unknown
+	switch e.Code() {
+	case "RequestTimeTooSkewed":
+		if r.HTTPResponse == nil {
+			return
+		}
+		serverTime, err := http.ParseTime(r.HTTPResponse.Header.Get("Date"))
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(&c.offset, int64(time.Until(serverTime)))
+		r.Retryable = aws.Bool(true)
+	case "XAmzContentSHA256Mismatch":
+		r.Retryable = aws.Bool(true)
 	}
 }
 
-// ListPaged implements driver.ListPaged.
-func (b *bucket) ListPaged(ctx context.Context, opts *driver.ListOptions) (*driver.ListPage, error) {
-	pageSize := opts.PageSize
-	if pageSize == 0 {
-		pageSize = defaultPageSize
-	}
-	in := &s3.ListObjectsV2Input{
-		Bucket:  aws.String(b.name),
-		MaxKeys: aws.Int64(int64(pageSize)),
+// bucketCreator creates a bucket when a write fails because it doesn't
+// exist; see Options.CreateBucketIfMissing.
+type bucketCreator struct {
+	client *s3.S3
+	name   string
+}
+
+// retryHandler is an AWS SDK Retry handler that creates c's bucket when a
+// write failed with NoSuchBucket, and makes the write retryable once.
+func (c *bucketCreator) retryHandler(r *request.Request) {
+	e, ok := r.Error.(awserr.Error)
+	if !ok || e.Code() != "NoSuchBucket" {
+		return
 	}
-	if len(opts.PageToken) > 0 {
-		in.ContinuationToken = aws.String(string(opts.PageToken))
+	if r.Operation.Name != "PutObject" && r.Operation.Name != "CreateMultipartUpload" {
+		return
 	}
-	if opts.Prefix != "" {
-		in.Prefix = aws.String(opts.Prefix)
+	if _, retried := r.Retryer.(onceMoreRetryer); retried {
+		return
 	}
-	if opts.Delimiter != "" {
-		in.Delimiter = aws.String(opts.Delimiter)
+	in := &s3.CreateBucketInput{Bucket: aws.String(c.name)}
+	// us-east-1 is the default and must not be given as a constraint.
+	if region := aws.StringValue(c.client.Config.Region); region != "" && region != "us-east-1" {
+		in.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(region)}
 	}
-	if opts.BeforeList != nil {
-		asFunc := func(i interface{}) bool {
-			p, ok := i.(**s3.ListObjectsV2Input)
-			if !ok {
-				return false
-			}
-			*p = in
-			return true
-		}
-		if err := opts.BeforeList(asFunc); err != nil {
-			return nil, err
+	if _, err := c.client.CreateBucketWithContext(r.Context(), in); err != nil {
+		// Another writer may have created it concurrently.
+		if e, ok := err.(awserr.Error); !ok || e.Code() != s3.ErrCodeBucketAlreadyOwnedByYou {
+			return
 		}
 	}
-	req, resp := b.client.ListObjectsV2Request(in)
-	if err := req.Send(); err != nil {
-		return nil, err
+	r.Retryer = onceMoreRetryer{Retryer: r.Retryer, max: r.RetryCount + 1}
+	r.Retryable = aws.Bool(true)
+}
+
+// onceMoreRetryer is a request.Retryer that allows at least max retries, so
+// that a request can be retried even if its Retryer doesn't allow more.
+type onceMoreRetryer struct {
+	request.Retryer
+	max int
+}
+
+func (r onceMoreRetryer) MaxRetries() int {
+	if n := r.Retryer.MaxRetries(); n > r.max {
+		return n
 	}
-	page := driver.ListPage{}
-	if resp.NextContinuationToken != nil {
-		page.NextPageToken = []byte(*resp.NextContinuationToken)
+	return r.max
+}
+
+// WriteRetryConfig configures Options.WriteRetry.
+type WriteRetryConfig struct {
+	// MaxAttempts is the largest number of times a write request is sent
+	// while S3 responds with SlowDown, including the first. If zero, 5.
+	MaxAttempts int
+	// BaseDelay is the longest wait before the first retry; it doubles for
+	// each subsequent one, up to MaxDelay. Each wait is random, between zero
+	// and that limit ("full jitter"), so that writers throttled at once
+	// don't all retry at once. If zero, 100ms.
+	BaseDelay time.Duration
+	// MaxDelay is the longest wait before any retry. If zero, 5s.
+	MaxDelay time.Duration
+}
+
+// validate returns an error if c is invalid, and otherwise c with the
+// defaults set.
+func (c WriteRetryConfig) validate() (*WriteRetryConfig, error) {
+	if c.MaxAttempts < 0 || c.BaseDelay < 0 || c.MaxDelay < 0 {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: WriteRetry fields must not be negative, got %+v", c)
 	}
-	if n := len(resp.Contents) + len(resp.CommonPrefixes); n > 0 {
-		page.Objects = make([]*driver.ListObject, n)
-		for i, obj := range resp.Contents {
-			page.Objects[i] = &driver.ListObject{
-				Key:     *obj.Key,
-				ModTime: *obj.LastModified,
-				Size:    *obj.Size,
-				MD5:     eTagToMD5(obj.ETag),
-				AsFunc: func(i interface{}) bool {
-					p, ok := i.(*s3.Object)
-					if !ok {
-						return false
-					}
-					*p = *obj
-					return true
-				},
-			}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 5
+	}
+	if c.BaseDelay == 0 {
+		c.BaseDelay = 100 * time.Millisecond
+	}
+	if c.MaxDelay == 0 {
+		c.MaxDelay = 5 * time.Second
+	}
+	return &c, nil
+}
+
+// requestOption returns a request option that applies c to write requests.
+func (c *WriteRetryConfig) requestOption() request.Option {
+	return func(r *request.Request) {
+		switch r.Operation.Name {
+		case "PutObject", "CreateMultipartUpload", "UploadPart", "CompleteMultipartUpload":
+			r.Retryer = slowDownRetryer{Retryer: r.Retryer, cfg: c}
 		}
-		for i, prefix := range resp.CommonPrefixes {
-			page.Objects[i+len(resp.Contents)] = &driver.ListObject{
+	}
+}
+
+// slowDownRetryer is a request.Retryer that retries SlowDown errors as
+// configured by cfg, and defers to Retryer for other errors.
+type slowDownRetryer struct {
+	request.Retryer
+	cfg *WriteRetryConfig
+}
+
+func isSlowDown(r *request.Request) bool {
+	e, ok := r.Error.(awserr.Error)
+	return ok && e.Code() == "SlowDown"
+}
+
+func (r slowDownRetryer) MaxRetries() int {
+	if n := r.Retryer.MaxRetries(); n > r.cfg.MaxAttempts-1 {
+		return n
+	}
+	return r.cfg.MaxAttempts - 1
+}
+
+func (r slowDownRetryer) ShouldRetry(req *request.Request) bool {
+	if isSlowDown(req) {
+		return true
+	}
+	// MaxRetries may allow more retries than Retryer does.
+	return req.RetryCount < r.Retryer.MaxRetries() && r.Retryer.ShouldRetry(req)
+}
+
+func (r slowDownRetryer) RetryRules(req *request.Request) time.Duration {
+	if !isSlowDown(req) {
+		return r.Retryer.RetryRules(req)
+	}
+	limit := r.cfg.MaxDelay
+	if req.RetryCount < 32 && r.cfg.BaseDelay<<uint(req.RetryCount) < limit {
+		limit = r.cfg.BaseDelay << uint(req.RetryCount)
+	}
+	if limit <= 0 {
+		// Overflowed.
+		limit = r.cfg.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// UploadStrategy is the way an object was uploaded; see UploadInfo.
+type UploadStrategy int
+
+const (
+	// UploadSinglePart is a single PutObject request. The object's ETag is
+	// the MD5 of its content.
+	UploadSinglePart UploadStrategy = iota
+	// UploadMultipart is a multipart upload. The object's ETag is not the
+	// MD5 of its content.
+	UploadMultipart
+)
+
+func (s UploadStrategy) String() string {
+	switch s {
+	case UploadSinglePart:
+		return "single-part"
+	case UploadMultipart:
+		return "multipart"
+	default:
+		return fmt.Sprintf("UploadStrategy(%d)", int(s))
+	}
+}
+
+// UploadInfo describes a successful upload; see Options.OnUpload.
+type UploadInfo struct {
+	// Key is the key of the object.
+	Key string
+	// Size is the size of the object in bytes.
+	Size int64
+	// Strategy is how the object was uploaded.
+	Strategy UploadStrategy
+	// Parts is the number of parts uploaded; it is 1 for UploadSinglePart.
+	Parts int
+}
+
+// sniffLen is the number of bytes http.DetectContentType considers.
+const sniffLen = 512
+
+// maxPutObjectSize is the largest object that can be uploaded in a single
+// PutObject request.
+const maxPutObjectSize = 5 << 30
+
+// expectedBucketOwnerHeader is the header used for
+// Options.ExpectedBucketOwner.
+const expectedBucketOwnerHeader = "X-Amz-Expected-Bucket-Owner"
+
+// requestPayerHeader is the header used for Options.RequesterPays.
+const requestPayerHeader = "X-Amz-Request-Payer"
+
+// A Decompressor returns a reader of the decompressed contents of r.
+// See Options.Decompressors.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// decompressor returns the Decompressor for an object with the given
+// metadata, or nil if it isn't compressed. See
+// Options.DecompressionMetadataKey.
+func (b *bucket) decompressor(md map[string]*string) (Decompressor, string, error) {
+	if b.opts.DecompressionMetadataKey == "" {
+		return nil, "", nil
+	}
+	var alg string
+	for k, v := range md {
+		if strings.EqualFold(k, b.opts.DecompressionMetadataKey) {
+			alg = aws.StringValue(v)
+			break
+		}
+	}
+	if alg == "" {
+		return nil, "", nil
+	}
+	if d := b.opts.Decompressors[alg]; d != nil {
+		return d, alg, nil
+	}
+	if alg == "gzip" {
+		return func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }, alg, nil
+	}
+	return nil, "", gcerr.Newf(gcerr.Unimplemented, nil, "s3blob: no decompressor for %q", alg)
+}
+
+// UncompressedSizeMetadataKey is the metadata key under which the size of
+// the decompressed content of a compressed object is stored, as a decimal
+// number; see Options.DecompressionMetadataKey.
+const UncompressedSizeMetadataKey = "uncompressed-size"
+
+// uncompressedSize returns the size of the decompressed content of the
+// object stored at key, with metadata md, which is compressed with alg.
+func uncompressedSize(key, alg string, md map[string]*string) (int64, error) {
+	for k, v := range md {
+		if strings.EqualFold(k, UncompressedSizeMetadataKey) {
+			n, err := strconv.ParseInt(aws.StringValue(v), 10, 64)
+			if err != nil || n < 0 {
+				return 0, gcerr.Newf(gcerr.FailedPrecondition, nil, "s3blob: invalid %s metadata %q of %q", UncompressedSizeMetadataKey, aws.StringValue(v), key)
+			}
+			return n, nil
+		}
+	}
+	return 0, gcerr.Newf(gcerr.FailedPrecondition, nil, "s3blob: %q is compressed with %s but has no %s metadata", key, alg, UncompressedSizeMetadataKey)
+}
+
+// SHA256MetadataKey is the metadata key under which the SHA-256 of an
+// object is stored; see Options.SHA256Metadata.
+const SHA256MetadataKey = "sha256"
+
+// SHA256MetadataMaxSize is the largest object that can be written with
+// Options.SHA256Metadata set.
+const SHA256MetadataMaxSize = 256 << 20
+
+// storageClasses are the storage classes that objects can be written with.
+var storageClasses = []string{
+	s3.StorageClassStandard,
+	s3.StorageClassReducedRedundancy,
+	s3.StorageClassStandardIa,
+	s3.StorageClassOnezoneIa,
+	s3.StorageClassIntelligentTiering,
+	s3.StorageClassGlacier,
+}
+
+// validateStorageClass returns an error if class is not empty and not one
+// of storageClasses. All paths that write objects must use it.
+func validateStorageClass(class string) error {
+	if class == "" {
+		return nil
+	}
+	for _, c := range storageClasses {
+		if class == c {
+			return nil
+		}
+	}
+	return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: unsupported storage class %q; must be one of %s", class, strings.Join(storageClasses, ", "))
+}
+
+// cannedACLs are the canned ACLs that objects can be written with.
+// See https://docs.aws.amazon.com/AmazonS3/latest/dev/acl-overview.html#canned-acl.
+var cannedACLs = []string{
+	s3.ObjectCannedACLPrivate,
+	s3.ObjectCannedACLPublicRead,
+	s3.ObjectCannedACLPublicReadWrite,
+	s3.ObjectCannedACLAuthenticatedRead,
+	s3.ObjectCannedACLAwsExecRead,
+	s3.ObjectCannedACLBucketOwnerRead,
+	s3.ObjectCannedACLBucketOwnerFullControl,
+}
+
+// validateACL returns an error if acl is not empty and not one of
+// cannedACLs.
+func validateACL(acl string) error {
+	if acl == "" {
+		return nil
+	}
+	for _, a := range cannedACLs {
+		if acl == a {
+			return nil
+		}
+	}
+	return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: unsupported canned ACL %q; must be one of %s", acl, strings.Join(cannedACLs, ", "))
+}
+
+// normalizeKey returns the key to use in requests for key; see
+// Options.NormalizeKeys.
+func (b *bucket) normalizeKey(key string) string {
+	if !b.opts.NormalizeKeys {
+		return key
+	}
+	key = strings.TrimPrefix(key, "/")
+	if b.opts.CollapseSlashes {
+		for strings.Contains(key, "//") {
+			key = strings.Replace(key, "//", "/", -1)
+		}
+	}
+	return key
+}
+
+// hashKey returns the S3 key for key, which must already have been
+// normalized; see Options.KeyHashPrefixLen.
+func (b *bucket) hashKey(key string) string {
+	n := b.opts.KeyHashPrefixLen
+	if n == 0 {
+		return key
+	}
+	sum := md5.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])[:n] + "/" + key
+}
+
+// objectKey returns the S3 key for the object that callers call key.
+func (b *bucket) objectKey(key string) string {
+	return b.hashKey(b.normalizeKey(key))
+}
+
+// logicalKey is the inverse of hashKey. It reports false if s3Key was not
+// written using hashKey.
+func (b *bucket) logicalKey(s3Key string) (string, bool) {
+	n := b.opts.KeyHashPrefixLen
+	if n == 0 {
+		return s3Key, true
+	}
+	if len(s3Key) <= n || s3Key[n] != '/' {
+		return "", false
+	}
+	key := s3Key[n+1:]
+	return key, b.hashKey(key) == s3Key
+}
+
+// limitTransport is an http.RoundTripper that limits the number of requests
+// in flight; see Options.MaxConcurrentOps.
+type limitTransport struct {
+	base http.RoundTripper
+	sem  chan struct{}
+}
+
+func newLimitTransport(base http.RoundTripper, n int) *limitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &limitTransport{base: base, sem: make(chan struct{}, n)}
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		<-t.sem
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { <-t.sem }}
+	return resp, nil
+}
+
+// releasingBody calls release once when it is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// openBucket returns an S3 Bucket.
+func openBucket(ctx context.Context, sess client.ConfigProvider, bucketName string, opts *Options) (*bucket, error) {
+	if sess == nil {
+		return nil, errors.New("s3blob.OpenBucket: sess is required")
+	}
+	if bucketName == "" {
+		return nil, errors.New("s3blob.OpenBucket: bucketName is required")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	// Defaults are filled in below; don't modify the caller's Options.
+	o := *opts
+	opts = &o
+	if err := opts.WriteDefaults.validate(); err != nil {
+		return nil, err
+	}
+	if t := opts.MultipartThreshold; t != 0 && (t < s3manager.MinUploadPartSize || t > maxPutObjectSize) {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: MultipartThreshold must be between %d and %d, got %d", s3manager.MinUploadPartSize, maxPutObjectSize, t)
+	}
+	if s := opts.MinPartSize; s != 0 && (s < s3manager.MinUploadPartSize || s > maxPutObjectSize) {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: MinPartSize must be between %d and %d, got %d", s3manager.MinUploadPartSize, maxPutObjectSize, s)
+	}
+	if opts.DefaultPageSize < 0 {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: DefaultPageSize must not be negative, got %d", opts.DefaultPageSize)
+	}
+	if opts.DefaultPageSize > defaultPageSize {
+		opts.DefaultPageSize = defaultPageSize
+	}
+	if opts.KeyHashPrefixLen < 0 || opts.KeyHashPrefixLen > 2*md5.Size {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: KeyHashPrefixLen must be between 0 and %d, got %d", 2*md5.Size, opts.KeyHashPrefixLen)
+	}
+	if opts.UploadConcurrency < 0 {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: UploadConcurrency must not be negative, got %d", opts.UploadConcurrency)
+	}
+	if opts.MaxRetries != nil && *opts.MaxRetries < 0 {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: MaxRetries must not be negative, got %d", *opts.MaxRetries)
+	}
+	if opts.WriteRetry != nil {
+		c, err := opts.WriteRetry.validate()
+		if err != nil {
+			return nil, err
+		}
+		opts.WriteRetry = c
+	}
+	if m := opts.MaxSignedURLExpiry; m < 0 || m > MaxPresignExpiry {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: MaxSignedURLExpiry must be between 0 and %v, got %v", MaxPresignExpiry, m)
+	}
+	if opts.MaxSignedURLExpiry == 0 {
+		opts.MaxSignedURLExpiry = MaxPresignExpiry
+	}
+	if e := opts.SignedURLExpiry; e < 0 || e > opts.MaxSignedURLExpiry {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: SignedURLExpiry must be between 0 and %v, got %v", opts.MaxSignedURLExpiry, e)
+	}
+	if (opts.RoleARN == "") != (opts.WebIdentityTokenFile == "") {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: RoleARN and WebIdentityTokenFile must be set together")
+	}
+	if opts.WebIdentityTokenFile != "" && opts.Credentials != nil {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: WebIdentityTokenFile can't be combined with Credentials")
+	}
+	cfg := &aws.Config{}
+	if opts.Credentials != nil {
+		cfg.Credentials = opts.Credentials
+	}
+	if opts.WebIdentityTokenFile != "" {
+		cfg.Credentials = newWebIdentityCredentials(sess, opts.RoleARN, opts.WebIdentityTokenFile, opts.RoleSessionName)
+	}
+	if opts.MaxRetries != nil {
+		cfg.MaxRetries = aws.Int(*opts.MaxRetries)
+	}
+	if opts.UseDualStack {
+		cfg.UseDualStack = aws.Bool(true)
+	}
+	if opts.UseAccelerate {
+		if aws.BoolValue(sess.ClientConfig(s3.ServiceName).Config.S3ForcePathStyle) {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: UseAccelerate is incompatible with aws.Config.S3ForcePathStyle")
+		}
+		cfg.S3UseAccelerate = aws.Bool(true)
+	}
+	if opts.DisableContentMD5Validation {
+		cfg.S3DisableContentMD5Validation = aws.Bool(true)
+	}
+	if opts.HTTPClient != nil {
+		cfg.HTTPClient = opts.HTTPClient
+	}
+	if opts.MaxConcurrentOps > 0 {
+		hc := http.DefaultClient
+		if opts.HTTPClient != nil {
+			hc = opts.HTTPClient
+		} else if c := sess.ClientConfig(s3.ServiceName).Config.HTTPClient; c != nil {
+			hc = c
+		}
+		limited := *hc
+		limited.Transport = newLimitTransport(hc.Transport, opts.MaxConcurrentOps)
+		cfg.HTTPClient = &limited
+	}
+	client := s3.New(sess, cfg)
+	if opts.CorrectClockSkew {
+		skew := &clockSkew{}
+		client.Handlers.Sign.Swap(v4.SignRequestHandler.Name, request.NamedHandler{
+			Name: v4.SignRequestHandler.Name,
+			Fn: func(r *request.Request) {
+				// Same as the S3 client's default signer, with the corrected time.
+				v4.SignSDKRequestWithCurrentTime(r, skew.now, func(s *v4.Signer) {
+					s.DisableURIPathEscaping = true
+				})
+			},
+		})
+		client.Handlers.Retry.PushBack(skew.retryHandler)
+	}
+	if opts.CreateBucketIfMissing {
+		c := &bucketCreator{client: client, name: bucketName}
+		client.Handlers.Retry.PushBack(c.retryHandler)
+	}
+	if owner := opts.ExpectedBucketOwner; owner != "" {
+		// Set in the Build phase so that the header is signed.
+		client.Handlers.Build.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set(expectedBucketOwnerHeader, owner)
+		})
+	}
+	if opts.RequesterPays {
+		// Set for every operation, not just those whose input has a
+		// RequestPayer field, and signed, like ExpectedBucketOwner.
+		client.Handlers.Build.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set(requestPayerHeader, s3.RequestPayerRequester)
+		})
+	}
+	b := &bucket{
+		name:   bucketName,
+		sess:   sess,
+		client: client,
+		opts:   opts,
+	}
+	if opts.CheckBucketExists && !opts.CreateBucketIfMissing {
+		exists, err := b.exists(ctx)
+		if err != nil {
+			return nil, b.wrapError(err)
+		}
+		if !exists {
+			return nil, gcerr.Newf(gcerr.NotFound, nil, "s3blob: bucket %q does not exist", bucketName)
+		}
+	}
+	return b, nil
+}
+
+// BucketExists reports whether bkt, which must have been opened by this
+// package, exists. It returns an error if that can't be determined, e.g.
+// because the bucket exists but the caller may not access it, in which case
+// gcerrors.Code returns gcerrors.PermissionDenied.
+//
+// Operations on a bucket that doesn't exist fail with an error for which
+// gcerrors.Code returns gcerrors.NotFound, like those on a missing object;
+// use BucketExists, or blob.Bucket.ErrorAs with awserr.Error and the code
+// "NoSuchBucket", to tell them apart.
+//
+// BucketExists makes a single HeadBucket request, which is cheaper than
+// listing or reading objects and succeeds for an empty bucket, so it is
+// suitable for readiness probes, e.g. with a context with a short timeout
+// in a health.Checker: the bucket is ready if it returns true and a nil
+// error.
+func BucketExists(ctx context.Context, bkt *blob.Bucket) (bool, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return false, err
+	}
+	exists, err := b.exists(ctx)
+	return exists, b.wrapError(err)
+}
+
+// exists reports whether b's bucket exists.
+func (b *bucket) exists(ctx context.Context) (bool, error) {
+	_, err := b.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(b.name)})
+	if err != nil {
+		// HeadBucket responses have no body, so the code is derived from
+		// the status.
+		if e, ok := err.(awserr.Error); ok && (e.Code() == "NotFound" || e.Code() == "NoSuchBucket") {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// OpenBucket returns a *blob.Bucket backed by S3. See the package documentation
+// for an example.
+func OpenBucket(ctx context.Context, sess client.ConfigProvider, bucketName string, opts *Options) (*blob.Bucket, error) {
+	drv, err := openBucket(ctx, sess, bucketName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return blob.NewBucket(drv), nil
+}
+
+// reader reads an S3 object. It implements io.ReadCloser.
+type reader struct {
+	body  io.ReadCloser
+	attrs driver.ReaderAttributes
+	raw   *s3.GetObjectOutput
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	return r.body.Read(p)
+}
+
+// Close closes the reader itself. It must be called when done reading.
+func (r *reader) Close() error {
+	return r.body.Close()
+}
+
+func (r *reader) As(i interface{}) bool {
+	p, ok := i.(*s3.GetObjectOutput)
+	if !ok {
+		return false
+	}
+	*p = *r.raw
+	return true
+}
+
+func (r *reader) Attributes() driver.ReaderAttributes {
+	return r.attrs
+}
+
+// decompressingReader reads the decompressed contents of body.
+type decompressingReader struct {
+	io.ReadCloser // the decompressor
+	body          io.ReadCloser
+}
+
+// Close closes both the decompressor and the underlying body.
+func (r *decompressingReader) Close() error {
+	err := r.ReadCloser.Close()
+	if berr := r.body.Close(); err == nil {
+		err = berr
+	}
+	return err
+}
+
+// writer writes an S3 object, it implements io.WriteCloser.
+//
+// Bytes are buffered in memory until more than a single part's worth (or
+// Options.MultipartThreshold, if larger) has been written. If Close is called before that, the object is uploaded from
+// the buffer with a single PutObject request, made by Close itself, which
+// can be replayed if the connection is reset; small writes never create the
+// pipe or the goroutine below. Otherwise the buffer is flushed into a pipe
+// that is streamed to S3 by a separate goroutine; retries for that case are
+// left to the AWS SDK, which retries each part individually.
+type writer struct {
+	w       *io.PipeWriter // created when more than bufSize bytes are written
+	buf     []byte         // bytes written before w was created
+	bufSize int
+
+	ctx      context.Context
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	req      *s3manager.UploadInput
+	donec    chan struct{} // closed when done writing
+	// The following fields will be written before donec closes:
+	err error
+
+	// afterUpload, if not nil, is called after a successful upload.
+	afterUpload func() error
+
+	// hashMetadata is set if the entire object must be buffered so that its
+	// SHA-256 can be stored in its metadata; see Options.SHA256Metadata.
+	hashMetadata bool
+
+	// contentLength, if positive, is the number of bytes the caller said it
+	// would write; see WriterOptions.ContentLength. It is at most bufSize,
+	// so they are all buffered.
+	contentLength int64
+
+	// key, size (the number of bytes written to w) and uploadID (set by a
+	// successful multipart upload) are used to report an UploadInfo to
+	// onUpload, if it is not nil.
+	key      string
+	size     int64
+	uploadID string
+	onUpload func(UploadInfo)
+
+	// initiateFailed is set by the upload goroutine if the
+	// CreateMultipartUpload request failed.
+	initiateFailed bool
+
+	// checksum, if not nil, verifies the checksums of the upload; see
+	// WriterOptions.ChecksumSHA256.
+	checksum *checksumVerifier
+
+	// detectContentType is set if the content type of the upload is to be
+	// detected from its content; see Options.DetectContentType.
+	detectContentType bool
+
+	// writeErr is the error returned by Write once the upload has failed;
+	// see UploadFailedError. Unlike err, it is only accessed by Write.
+	writeErr error
+}
+
+// initiateOption returns a request option for w's uploader that marks the
+// writer if CreateMultipartUpload fails, and sets the number of times it is
+// retried if retries is positive.
+func (w *writer) initiateOption(retries int) request.Option {
+	return func(r *request.Request) {
+		if r.Operation.Name != "CreateMultipartUpload" {
+			return
+		}
+		if retries > 0 {
+			r.Retryer = client.DefaultRetryer{NumMaxRetries: retries}
+		}
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			w.initiateFailed = r.Error != nil
+		})
+	}
+}
+
+// uploadError returns the error to report for err, returned by the
+// uploader.
+func (w *writer) uploadError(err error) error {
+	if err != nil && w.initiateFailed {
+		return &MultipartInitiationError{Err: err}
+	}
+	return err
+}
+
+// maxResetRetries is the number of times an upload from the in-memory buffer
+// is retried after the connection is reset.
+const maxResetRetries = 3
+
+// Write appends p to w. User must call Close to close the w after done writing.
+func (w *writer) Write(p []byte) (int, error) {
+	// Avoid opening the pipe for a zero-length write;
+	// the concrete can do these for empty blobs.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if w.contentLength > 0 && int64(len(w.buf)+len(p)) > w.contentLength {
+		w.err = gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: wrote more than WriterOptions.ContentLength (%d) bytes", w.contentLength)
+		return 0, w.err
+	}
+	if w.hashMetadata {
+		if w.err != nil {
+			return 0, w.err
+		}
+		if len(w.buf)+len(p) > SHA256MetadataMaxSize {
+			w.err = gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: objects written with Options.SHA256Metadata may be at most %d bytes", SHA256MetadataMaxSize)
+			return 0, w.err
+		}
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+	if w.w == nil {
+		if len(w.buf)+len(p) <= w.bufSize {
+			w.buf = append(w.buf, p...)
+			return len(p), nil
+		}
+		if w.detectContentType {
+			// The start of the content is in w.buf, possibly followed by p.
+			head := w.buf
+			if n := sniffLen - len(head); n > 0 {
+				if n > len(p) {
+					n = len(p)
+				}
+				head = append(head[:len(head):len(head)], p[:n]...)
+			}
+			w.req.ContentType = aws.String(http.DetectContentType(head))
+		}
+		// We'll write into pw and use pr as an io.Reader for the
+		// Upload call to S3.
+		pr, pw := io.Pipe()
+		w.w = pw
+		if err := w.open(pr); err != nil {
+			return 0, err
+		}
+		buf := w.buf
+		w.buf = nil
+		if _, err := w.write(buf); err != nil {
+			return 0, err
+		}
+	}
+	return w.write(p)
+}
+
+// write writes p to the pipe, unless the upload has already failed.
+func (w *writer) write(p []byte) (int, error) {
+	if w.writeErr != nil {
+		return 0, w.writeErr
+	}
+	select {
+	case <-w.donec:
+		// The upload ended before all the content was written, so it
+		// failed; w.err is safe to read once donec is closed.
+		err := w.err
+		if err == nil {
+			err = gcerr.Newf(gcerr.Internal, nil, "s3blob: upload ended before all data was written")
+		}
+		w.writeErr = &UploadFailedError{Err: err}
+		return 0, w.writeErr
+	default:
+	}
+	n, err := w.w.Write(p)
+	w.size += int64(n)
+	if w.checksum != nil && w.checksum.want != "" {
+		w.checksum.h.Write(p[:n])
+	}
+	if err != nil {
+		// The upload goroutine closed the pipe with its error.
+		w.writeErr = &UploadFailedError{Err: err}
+		return n, w.writeErr
+	}
+	return n, nil
+}
+
+func (w *writer) open(pr *io.PipeReader) error {
+	go func() {
+		defer close(w.donec)
+
+		w.req.Body = pr
+		out, err := w.uploader.UploadWithContext(w.ctx, w.req)
+		if err != nil {
+			w.err = w.uploadError(err)
+			pr.CloseWithError(w.err)
+			return
+		}
+		w.uploadID = out.UploadID
+	}()
+	return nil
+}
+
+// uploadBuffered uploads the contents of w.buf, retrying if the connection
+// is reset. The SDK's retryer doesn't retry these: it gives up on network
+// errors that aren't temporary, and a reset while reading the response
+// isn't, although the body is replayable. So the attempts don't multiply
+// with Options.MaxRetries. Streamed uploads are retried by the SDK one part
+// at a time, for the errors it considers retryable.
+func (w *writer) uploadBuffered() error {
+	for i := 0; ; i++ {
+		// Skip the uploader, which would use multiple parts if the buffer is
+		// larger than a part, because of Options.MultipartThreshold, and
+		// otherwise makes the same request.
+		// AWS doesn't like a nil Body, so this is also used for empty objects.
+		err := w.putObject(bytes.NewReader(w.buf))
+		if err == nil || i == maxResetRetries || !isConnectionReset(err) {
+			return err
+		}
+	}
+}
+
+// putObject uploads body with a single PutObject request.
+func (w *writer) putObject(body io.ReadSeeker) error {
+	in := &s3.PutObjectInput{}
+	awsutil.Copy(in, w.req)
+	in.Body = body
+	_, err := w.client.PutObjectWithContext(w.ctx, in, w.uploader.RequestOptions...)
+	return err
+}
+
+// isConnectionReset reports whether err is an AWS request error caused by
+// the connection being reset.
+func isConnectionReset(err error) bool {
+	e, ok := err.(awserr.Error)
+	if !ok || e.OrigErr() == nil {
+		return false
+	}
+	return strings.Contains(e.OrigErr().Error(), "connection reset")
+}
+
+// Close completes the writer and close it. Any error occuring during write will
+// be returned. If a writer is closed before any Write is called, Close will
+// create an empty file at the given key.
+func (w *writer) Close() error {
+	if w.w == nil {
+		if w.err != nil {
+			// A buffered write failed; don't upload a truncated object.
+			return w.err
+		}
+		if w.contentLength > 0 && int64(len(w.buf)) != w.contentLength {
+			w.err = gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: wrote %d bytes, less than WriterOptions.ContentLength (%d)", len(w.buf), w.contentLength)
+			return w.err
+		}
+		if w.hashMetadata {
+			sum := sha256.Sum256(w.buf)
+			if w.req.Metadata == nil {
+				w.req.Metadata = map[string]*string{}
+			}
+			w.req.Metadata[SHA256MetadataKey] = aws.String(hex.EncodeToString(sum[:]))
+		}
+		if w.detectContentType {
+			w.req.ContentType = aws.String(http.DetectContentType(w.buf))
+		}
+		// Everything we got fit in the buffer.
+		w.size = int64(len(w.buf))
+		w.err = w.uploadBuffered()
+		close(w.donec)
+	} else {
+		if w.checksum != nil {
+			if err := w.checksum.checkContent(); err != nil {
+				// Abort the upload rather than complete it.
+				w.w.CloseWithError(err)
+				<-w.donec
+				return err
+			}
+		}
+		if err := w.w.Close(); err != nil {
+			return err
+		}
+	}
+	<-w.donec
+	if w.checksum != nil && w.checksum.err != nil {
+		// Report the mismatch rather than the uploader's wrapping of it.
+		w.err = w.checksum.err
+	}
+	if w.err == nil && w.afterUpload != nil {
+		w.err = w.afterUpload()
+	}
+	if w.err == nil && w.onUpload != nil {
+		w.onUpload(w.uploadInfo())
+	}
+	return w.err
+}
+
+// uploadFrom uploads the size bytes that remain in r instead of the bytes
+// written to w, which must not have been written to, and completes w like
+// Close. Since the size is known, objects of up to w.bufSize bytes are
+// uploaded with a single PutObject request without buffering them, and
+// larger ones are uploaded in parts read directly from r.
+func (w *writer) uploadFrom(r io.ReadSeeker, size int64) error {
+	if w.hashMetadata {
+		start, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return err
+		}
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		if w.req.Metadata == nil {
+			w.req.Metadata = map[string]*string{}
+		}
+		w.req.Metadata[SHA256MetadataKey] = aws.String(hex.EncodeToString(h.Sum(nil)))
+	}
+	w.size = size
+	if size <= int64(w.bufSize) {
+		w.err = w.putObject(r)
+	} else {
+		w.req.Body = r
+		out, err := w.uploader.UploadWithContext(w.ctx, w.req)
+		if err == nil {
+			w.uploadID = out.UploadID
+		}
+		w.err = w.uploadError(err)
+	}
+	close(w.donec)
+	if w.err == nil && w.afterUpload != nil {
+		w.err = w.afterUpload()
+	}
+	if w.err == nil && w.onUpload != nil {
+		w.onUpload(w.uploadInfo())
+	}
+	return w.err
+}
+
+// UploadFromSeeker writes the content of r, from its current offset to its
+// end, to key in bkt, which must have been opened by this package. Unlike a
+// blob.Writer, which has to buffer content to decide how to upload it,
+// UploadFromSeeker determines the size by seeking, so that objects up to
+// Options.MultipartThreshold (or the part size, if larger) are uploaded with
+// a single PutObject request, and thus have the MD5 of their content as
+// ETag, and larger ones are uploaded in parts read directly from r. Neither
+// needs an in-memory copy of the object.
+//
+// opts is applied as by blob.Bucket.NewWriter, except that
+// ContentTypeOverrides is not supported: if opts.ContentType is empty, the
+// content type is detected from the first 512 bytes of r. opts may be nil.
+func UploadFromSeeker(ctx context.Context, bkt *blob.Bucket, key string, r io.ReadSeeker, opts *blob.WriterOptions) error {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &blob.WriterOptions{}
+	}
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	contentType := opts.ContentType
+	if contentType == "" {
+		buf := make([]byte, sniffLen)
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		contentType = http.DetectContentType(buf[:n])
+	} else if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return gcerr.Newf(gcerr.InvalidArgument, err, "s3blob: invalid ContentType %q", contentType)
+	}
+	md, err := driver.LowercaseMetadata(opts.Metadata)
+	if err != nil {
+		return gcerr.Newf(gcerr.InvalidArgument, err, "s3blob: invalid metadata")
+	}
+	dw, err := b.NewTypedWriter(ctx, key, contentType, &driver.WriterOptions{
+		BufferSize:         opts.BufferSize,
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		ContentEncoding:    opts.ContentEncoding,
+		ContentLanguage:    opts.ContentLanguage,
+		ContentMD5:         opts.ContentMD5,
+		Metadata:           md,
+		BeforeWrite:        opts.BeforeWrite,
+	})
+	if err != nil {
+		return b.wrapError(err)
+	}
+	return b.wrapError(dw.(*writer).uploadFrom(r, end-start))
+}
+
+// uploadInfo returns the UploadInfo for a successful upload.
+func (w *writer) uploadInfo() UploadInfo {
+	info := UploadInfo{Key: w.key, Size: w.size, Strategy: UploadSinglePart, Parts: 1}
+	if w.uploadID != "" {
+		info.Strategy = UploadMultipart
+		partSize := w.uploader.PartSize
+		if w.w == nil && info.Size/partSize >= int64(w.uploader.MaxUploadParts) {
+			// The uploader increases the part size when it knows the size
+			// up front and there would be too many parts.
+			partSize = info.Size/int64(w.uploader.MaxUploadParts) + 1
+		}
+		info.Parts = int((info.Size + partSize - 1) / partSize)
+	}
+	return info
+}
+
+// bucket represents an S3 bucket and handles read, write and delete operations.
+type bucket struct {
+	name   string
+	sess   client.ConfigProvider
+	client *s3.S3
+	opts   *Options
+}
+
+func (b *bucket) ErrorCode(err error) gcerrors.ErrorCode {
+	if e, ok := err.(*UploadFailedError); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*MultipartInitiationError); ok {
+		err = e.Err
+	}
+	if f, ok := err.(s3manager.MultiUploadFailure); ok && f.OrigErr() != nil {
+		// Classify the error of the failed part or completion request.
+		err = f.OrigErr()
+	}
+	if e, ok := err.(*gcerr.Error); ok {
+		// Returned by this package, e.g. for invalid options.
+		return e.Code
+	}
+	if err == context.Canceled {
+		return gcerrors.Canceled
+	}
+	e, ok := err.(awserr.Error)
+	if !ok {
+		return gcerrors.Unknown
+	}
+	switch code := e.Code(); {
+	case code == "NoSuchKey" || code == "NotFound" || code == "NoSuchUpload" || code == "NoSuchVersion" || code == "NoSuchBucket":
+		return gcerrors.NotFound
+	case code == request.CanceledErrorCode:
+		// The request's context was canceled or its deadline exceeded.
+		return gcerrors.Canceled
+	case code == "AccessDenied" || code == "Forbidden":
+		return gcerrors.PermissionDenied
+	case code == "PreconditionFailed" || code == "NotModified":
+		return gcerrors.FailedPrecondition
+	case code == "RequestTimeTooSkewed" || code == "XAmzContentSHA256Mismatch":
+		return gcerrors.Unavailable
+	case strings.HasPrefix(code, "KMS."):
+		return kmsErrorCode(strings.TrimPrefix(code, "KMS."))
+	case code == "EntityTooLarge" || code == "EntityTooSmall" || code == "InvalidStorageClass" ||
+		code == "MetadataTooLarge" || code == "KeyTooLongError" || code == "InvalidEncryptionAlgorithmError" ||
+		code == "BadDigest" || code == "InvalidArgument":
+		return gcerrors.InvalidArgument
+	case code == "SlowDown" || code == "Throttling" || code == "ThrottlingException" ||
+		code == "RequestLimitExceeded" || code == "TooManyBuckets" || code == "ServiceQuotaExceededException":
+		return gcerrors.ResourceExhausted
+	default:
+		return gcerrors.Unknown
+	}
+}
+
+// kmsErrorCode classifies the KMS error codes that S3 returns, without their
+// "KMS." prefix, when it fails to use the KMS key of an encrypted object.
+func kmsErrorCode(code string) gcerrors.ErrorCode {
+	switch code {
+	case "NotFoundException", "DisabledException", "KMSInvalidStateException", "InvalidKeyUsageException", "KeyUnavailableException":
+		return gcerrors.FailedPrecondition
+	case "AccessDeniedException", "InvalidGrantTokenException":
+		return gcerrors.PermissionDenied
+	case "ThrottlingException", "LimitExceededException":
+		return gcerrors.ResourceExhausted
+	default:
+		return gcerrors.Unknown
+	}
+}
+
+// ListPaged implements driver.ListPaged.
+//
+// S3 matches ListOptions.Prefix as a plain string prefix of keys, not as a
+// path: with Prefix "a/b", both "a/b/c" and "a/bar" match, and so does
+// "a/b" itself. With a Delimiter, keys are grouped into "directories" at the
+// first delimiter after the prefix, so Prefix "a/b" with Delimiter "/"
+// returns "a/b/" and "a/bar/" as directories (for keys "a/b/c" and
+// "a/bar/d") and "a/bar" as an object, while Prefix "a/b/" returns only
+// the entries inside "a/b/". Options.DirectoryPrefixes appends the delimiter
+// to prefixes that lack it.
+func (b *bucket) ListPaged(ctx context.Context, opts *driver.ListOptions) (*driver.ListPage, error) {
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = b.opts.DefaultPageSize
+	}
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	prefix := b.normalizeKey(opts.Prefix)
+	if b.opts.DirectoryPrefixes && prefix != "" {
+		delim := opts.Delimiter
+		if delim == "" {
+			delim = "/"
+		}
+		if !strings.HasSuffix(prefix, delim) {
+			prefix += delim
+		}
+	}
+	var listPrefix, listDelim *string
+	if b.opts.KeyHashPrefixLen > 0 {
+		// Objects are scattered across the hash prefixes, so list them all
+		// and filter below.
+		if opts.Delimiter != "" {
+			return nil, gcerr.Newf(gcerr.Unimplemented, nil, "s3blob: ListOptions.Delimiter is not supported with Options.KeyHashPrefixLen")
+		}
+	} else {
+		if prefix != "" {
+			listPrefix = aws.String(prefix)
+		}
+		if opts.Delimiter != "" {
+			listDelim = aws.String(opts.Delimiter)
+		}
+	}
+	var page *driver.ListPage
+	var err error
+	if b.opts.ListVersions {
+		page, err = b.listVersions(ctx, opts, pageSize, listPrefix, listDelim)
+	} else {
+		page, err = b.listObjects(ctx, opts, pageSize, listPrefix, listDelim)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.opts.KeyHashPrefixLen > 0 {
+		// Rebase to logical keys, dropping objects not under prefix.
+		objs := page.Objects[:0]
+		for _, obj := range page.Objects {
+			if key, ok := b.logicalKey(obj.Key); ok && strings.HasPrefix(key, prefix) {
+				obj.Key = key
+				objs = append(objs, obj)
+			}
+		}
+		page.Objects = objs
+	}
+	return page, nil
+}
+
+// listObjects returns a page of the latest versions of objects using
+// ListObjectsV2.
+func (b *bucket) listObjects(ctx context.Context, opts *driver.ListOptions, pageSize int, prefix, delim *string) (*driver.ListPage, error) {
+	in := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(b.name),
+		MaxKeys:   aws.Int64(int64(pageSize)),
+		Prefix:    prefix,
+		Delimiter: delim,
+	}
+	if len(opts.PageToken) > 0 {
+		in.ContinuationToken = aws.String(string(opts.PageToken))
+	}
+	if opts.BeforeList != nil {
+		asFunc := func(i interface{}) bool {
+			p, ok := i.(**s3.ListObjectsV2Input)
+			if !ok {
+				return false
+			}
+			*p = in
+			return true
+		}
+		if err := opts.BeforeList(asFunc); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := b.client.ListObjectsV2WithContext(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	page := driver.ListPage{
+		AsFunc: func(i interface{}) bool {
+			p, ok := i.(*s3.ListObjectsV2Output)
+			if !ok {
+				return false
+			}
+			*p = *resp
+			return true
+		},
+	}
+	if resp.NextContinuationToken != nil {
+		page.NextPageToken = []byte(*resp.NextContinuationToken)
+	}
+	if n := len(resp.Contents) + len(resp.CommonPrefixes); n > 0 {
+		page.Objects = make([]*driver.ListObject, n)
+		for i, obj := range resp.Contents {
+			page.Objects[i] = &driver.ListObject{
+				Key:     *obj.Key,
+				ModTime: *obj.LastModified,
+				Size:    *obj.Size,
+				MD5:     eTagToMD5(obj.ETag, b.opts.DecodeMultipartETags),
+				AsFunc: func(i interface{}) bool {
+					p, ok := i.(*s3.Object)
+					if !ok {
+						return false
+					}
+					*p = *obj
+					return true
+				},
+			}
+		}
+		for i, prefix := range resp.CommonPrefixes {
+			page.Objects[i+len(resp.Contents)] = &driver.ListObject{
 				Key:   *prefix.Prefix,
 				IsDir: true,
 				AsFunc: func(i interface{}) bool {
@@ -320,229 +2075,1712 @@ func (b *bucket) ListPaged(ctx context.Context, opts *driver.ListOptions) (*driv
 				},
 			}
 		}
-		if len(resp.Contents) > 0 && len(resp.CommonPrefixes) > 0 {
-			// S3 gives us blobs and "directories" in separate lists; sort them.
-			sort.Slice(page.Objects, func(i, j int) bool {
-				return page.Objects[i].Key < page.Objects[j].Key
+		if len(resp.Contents) > 0 && len(resp.CommonPrefixes) > 0 {
+			// S3 gives us blobs and "directories" in separate lists; sort them.
+			sort.Slice(page.Objects, func(i, j int) bool {
+				return page.Objects[i].Key < page.Objects[j].Key
+			})
+		}
+	}
+	return &page, nil
+}
+
+// versionsPageToken is the page token of a listing with
+// Options.ListVersions; S3 continues such listings from a key and version
+// rather than from an opaque token.
+type versionsPageToken struct {
+	KeyMarker       string `json:"k"`
+	VersionIDMarker string `json:"v,omitempty"`
+}
+
+// listVersions returns a page of object versions and delete markers using
+// ListObjectVersions; see Options.ListVersions.
+func (b *bucket) listVersions(ctx context.Context, opts *driver.ListOptions, pageSize int, prefix, delim *string) (*driver.ListPage, error) {
+	in := &s3.ListObjectVersionsInput{
+		Bucket:    aws.String(b.name),
+		MaxKeys:   aws.Int64(int64(pageSize)),
+		Prefix:    prefix,
+		Delimiter: delim,
+	}
+	if len(opts.PageToken) > 0 {
+		var tok versionsPageToken
+		if err := json.Unmarshal(opts.PageToken, &tok); err != nil {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, err, "s3blob: invalid page token")
+		}
+		in.KeyMarker = aws.String(tok.KeyMarker)
+		if tok.VersionIDMarker != "" {
+			in.VersionIdMarker = aws.String(tok.VersionIDMarker)
+		}
+	}
+	if opts.BeforeList != nil {
+		asFunc := func(i interface{}) bool {
+			p, ok := i.(**s3.ListObjectVersionsInput)
+			if !ok {
+				return false
+			}
+			*p = in
+			return true
+		}
+		if err := opts.BeforeList(asFunc); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := b.client.ListObjectVersionsWithContext(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	page := driver.ListPage{
+		AsFunc: func(i interface{}) bool {
+			p, ok := i.(*s3.ListObjectVersionsOutput)
+			if !ok {
+				return false
+			}
+			*p = *resp
+			return true
+		},
+	}
+	if aws.BoolValue(resp.IsTruncated) {
+		tok, err := json.Marshal(versionsPageToken{
+			KeyMarker:       aws.StringValue(resp.NextKeyMarker),
+			VersionIDMarker: aws.StringValue(resp.NextVersionIdMarker),
+		})
+		if err != nil {
+			return nil, err
+		}
+		page.NextPageToken = tok
+	}
+	for _, v := range resp.Versions {
+		v := v
+		page.Objects = append(page.Objects, &driver.ListObject{
+			Key:     *v.Key,
+			ModTime: *v.LastModified,
+			Size:    *v.Size,
+			MD5:     eTagToMD5(v.ETag, b.opts.DecodeMultipartETags),
+			AsFunc: func(i interface{}) bool {
+				p, ok := i.(*s3.ObjectVersion)
+				if !ok {
+					return false
+				}
+				*p = *v
+				return true
+			},
+		})
+	}
+	for _, m := range resp.DeleteMarkers {
+		m := m
+		page.Objects = append(page.Objects, &driver.ListObject{
+			Key:     *m.Key,
+			ModTime: *m.LastModified,
+			AsFunc: func(i interface{}) bool {
+				p, ok := i.(*s3.DeleteMarkerEntry)
+				if !ok {
+					return false
+				}
+				*p = *m
+				return true
+			},
+		})
+	}
+	for _, prefix := range resp.CommonPrefixes {
+		prefix := prefix
+		page.Objects = append(page.Objects, &driver.ListObject{
+			Key:   *prefix.Prefix,
+			IsDir: true,
+			AsFunc: func(i interface{}) bool {
+				p, ok := i.(*s3.CommonPrefix)
+				if !ok {
+					return false
+				}
+				*p = *prefix
+				return true
+			},
+		})
+	}
+	// S3 gives us versions, delete markers and "directories" in separate
+	// lists; merge them back into key order, newest version first.
+	sort.SliceStable(page.Objects, func(i, j int) bool {
+		oi, oj := page.Objects[i], page.Objects[j]
+		if oi.Key != oj.Key {
+			return oi.Key < oj.Key
+		}
+		return oi.ModTime.After(oj.ModTime)
+	})
+	return &page, nil
+}
+
+// As implements driver.As.
+func (b *bucket) As(i interface{}) bool {
+	switch p := i.(type) {
+	case **s3.S3:
+		*p = b.client
+		return true
+	case **bucket:
+		// Used by the package-level functions; see fromBucket.
+		*p = b
+		return true
+	}
+	return false
+}
+
+// fromBucket returns the driver underlying bkt, which must have been opened
+// by this package.
+func fromBucket(bkt *blob.Bucket) (*bucket, error) {
+	var b *bucket
+	if bkt == nil || !bkt.As(&b) {
+		return nil, errors.New("s3blob: bucket was not opened by s3blob")
+	}
+	return b, nil
+}
+
+// wrapError wraps err, which was returned by an S3 request made for b, the
+// same way the blob package wraps driver errors, so that gcerrors.Code and
+// blob.Bucket.ErrorAs work on it.
+func (b *bucket) wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return gcerr.New(b.ErrorCode(err), err, 2, "s3blob")
+}
+
+// GetRegion returns the AWS region in which bkt, which must have been opened
+// by this package, is located. It uses a HeadBucket request, so it works
+// regardless of the region the bucket's session is configured for.
+//
+// If the bucket does not exist, GetRegion returns an error for which
+// gcerrors.Code returns gcerrors.NotFound; if the region can't be determined
+// because access is denied, gcerrors.PermissionDenied.
+func GetRegion(ctx context.Context, bkt *blob.Bucket) (string, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return "", err
+	}
+	region, err := s3manager.GetBucketRegionWithClient(ctx, b.client, b.name)
+	if err != nil {
+		return "", b.wrapError(err)
+	}
+	return region, nil
+}
+
+// As implements driver.ErrorAs.
+func (b *bucket) ErrorAs(err error, i interface{}) bool {
+	switch v := err.(type) {
+	case *UploadFailedError:
+		if p, ok := i.(**UploadFailedError); ok {
+			*p = v
+			return true
+		}
+		return b.ErrorAs(v.Err, i)
+	case *MultipartInitiationError:
+		if p, ok := i.(**MultipartInitiationError); ok {
+			*p = v
+			return true
+		}
+		return b.ErrorAs(v.Err, i)
+	case awserr.Error:
+		if p, ok := i.(*awserr.Error); ok {
+			*p = v
+			return true
+		}
+		if f, ok := v.(s3manager.MultiUploadFailure); ok {
+			if p, ok := i.(*s3manager.MultiUploadFailure); ok {
+				*p = f
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Exists implements driver.ExistenceChecker.
+func (b *bucket) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := b.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(b.objectKey(key)),
+	})
+	if err != nil {
+		if b.ErrorCode(err) == gcerrors.NotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Attributes implements driver.Attributes.
+func (b *bucket) Attributes(ctx context.Context, key string) (driver.Attributes, error) {
+	return b.AttributesWithOptions(ctx, key, &driver.AttributesOptions{})
+}
+
+// AttributesWithOptions implements driver.AttributeGetter.
+func (b *bucket) AttributesWithOptions(ctx context.Context, key string, opts *driver.AttributesOptions) (driver.Attributes, error) {
+	key = b.objectKey(key)
+	in := &s3.HeadObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	}
+	var ho headOptions
+	if opts.BeforeAttributes != nil {
+		asFunc := func(i interface{}) bool {
+			switch p := i.(type) {
+			case **s3.HeadObjectInput:
+				*p = in
+			case **headOptions:
+				// Set by the package-level Attributes.
+				*p = &ho
+			default:
+				return false
+			}
+			return true
+		}
+		if err := opts.BeforeAttributes(asFunc); err != nil {
+			return driver.Attributes{}, err
+		}
+	}
+	var sum objectChecksum
+	var reqOpts []request.Option
+	if ho.checksum {
+		// Only on request: with checksum mode, S3 requires kms:Decrypt
+		// for objects encrypted with SSE-KMS.
+		reqOpts = append(reqOpts, sum.requestOption)
+	}
+	resp, err := b.client.HeadObjectWithContext(ctx, in, reqOpts...)
+	if err != nil {
+		return driver.Attributes{}, err
+	}
+	var md map[string]string
+	if len(resp.Metadata) > 0 {
+		md = make(map[string]string, len(resp.Metadata))
+		for k, v := range resp.Metadata {
+			if v != nil {
+				// See "Metadata" in the package documentation.
+				md[strings.ToLower(k)] = b.decodeMetadataValue(aws.StringValue(v))
+			}
+		}
+	}
+	restoreOngoing, restoreExpiry := parseRestore(aws.StringValue(resp.Restore))
+	storageClass := aws.StringValue(resp.StorageClass)
+	if storageClass == "" {
+		// S3 only reports the storage class of objects that aren't STANDARD.
+		storageClass = s3.StorageClassStandard
+	}
+	return driver.Attributes{
+		CacheControl:         aws.StringValue(resp.CacheControl),
+		ContentDisposition:   aws.StringValue(resp.ContentDisposition),
+		ContentEncoding:      aws.StringValue(resp.ContentEncoding),
+		ContentLanguage:      aws.StringValue(resp.ContentLanguage),
+		ContentType:          aws.StringValue(resp.ContentType),
+		Metadata:             md,
+		ModTime:              aws.TimeValue(resp.LastModified),
+		Size:                 aws.Int64Value(resp.ContentLength),
+		MD5:                  eTagToMD5(resp.ETag, b.opts.DecodeMultipartETags),
+		ETag:                 aws.StringValue(resp.ETag),
+		StorageClass:         storageClass,
+		ServerSideEncryption: aws.StringValue(resp.ServerSideEncryption),
+		VersionID:            aws.StringValue(resp.VersionId),
+		RestoreOngoing:       restoreOngoing,
+		RestoreExpiry:        restoreExpiry,
+		AsFunc: func(i interface{}) bool {
+			switch p := i.(type) {
+			case *s3.HeadObjectOutput:
+				*p = *resp
+			case *objectChecksum:
+				// See ChecksumOf.
+				*p = sum
+			default:
+				return false
+			}
+			return true
+		},
+	}, nil
+}
+
+// NewRangeReader implements driver.NewRangeReader.
+func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
+	key = b.objectKey(key)
+	in := &s3.GetObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	}
+	if offset < 0 {
+		// A suffix range; S3 returns the entire object if it is shorter.
+		in.Range = aws.String(fmt.Sprintf("bytes=%d", offset))
+	} else if offset > 0 && length < 0 {
+		in.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	} else if length > 0 {
+		in.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+	var ro readOptions
+	if opts.BeforeRead != nil {
+		asFunc := func(i interface{}) bool {
+			switch p := i.(type) {
+			case **s3.GetObjectInput:
+				*p = in
+			case **readOptions:
+				// Set by the package-level NewRangeReader.
+				*p = &ro
+			default:
+				return false
+			}
+			return true
+		}
+		if err := opts.BeforeRead(asFunc); err != nil {
+			return nil, err
+		}
+	}
+	if length == 0 {
+		// S3 doesn't support a zero-length range, and only the attributes
+		// are needed.
+		return b.headReader(ctx, in)
+	}
+	var sum objectChecksum
+	var reqOpts []request.Option
+	if ro.verifyChecksum && offset == 0 && length < 0 {
+		reqOpts = append(reqOpts, sum.requestOption)
+	}
+	resp, err := b.client.GetObjectWithContext(ctx, in, reqOpts...)
+	if offset < 0 && isInvalidRange(err) && in.Range != nil {
+		// S3 rejects any range of an empty object, but a suffix range
+		// reads all of an object shorter than it.
+		in.Range = nil
+		resp, err = b.client.GetObjectWithContext(ctx, in)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sum.algorithm != "" && !strings.Contains(sum.value, "-") {
+		// Verify the content as stored, before any decompression.
+		resp.Body = newChecksumReader(resp.Body, checksumAlgorithms[sum.algorithm], sum.value)
+	}
+	var body io.ReadCloser = resp.Body
+	size := getSize(resp)
+	d, alg, err := b.decompressor(resp.Metadata)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if d != nil {
+		if offset != 0 || length > 0 {
+			resp.Body.Close()
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: can't read a range of %q, which is compressed with %s", key, alg)
+		}
+		if size, err = uncompressedSize(key, alg, resp.Metadata); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		dr, err := d(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		body = &decompressingReader{ReadCloser: dr, body: resp.Body}
+	}
+	return &reader{
+		body: body,
+		attrs: driver.ReaderAttributes{
+			ContentType: aws.StringValue(resp.ContentType),
+			ModTime:     aws.TimeValue(resp.LastModified),
+			Size:        size,
+		},
+		raw: resp,
+	}, nil
+}
+
+// headReader returns a reader with no content for the object that in would
+// read, using a HeadObject request with the same conditions.
+func (b *bucket) headReader(ctx context.Context, in *s3.GetObjectInput) (driver.Reader, error) {
+	resp, err := b.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:               in.Bucket,
+		Key:                  in.Key,
+		VersionId:            in.VersionId,
+		PartNumber:           in.PartNumber,
+		IfMatch:              in.IfMatch,
+		IfModifiedSince:      in.IfModifiedSince,
+		IfNoneMatch:          in.IfNoneMatch,
+		IfUnmodifiedSince:    in.IfUnmodifiedSince,
+		RequestPayer:         in.RequestPayer,
+		SSECustomerAlgorithm: in.SSECustomerAlgorithm,
+		SSECustomerKey:       in.SSECustomerKey,
+		SSECustomerKeyMD5:    in.SSECustomerKeyMD5,
+	})
+	if err != nil {
+		return nil, err
+	}
+	size := aws.Int64Value(resp.ContentLength)
+	if d, alg, err := b.decompressor(resp.Metadata); err != nil {
+		return nil, err
+	} else if d != nil {
+		if size, err = uncompressedSize(aws.StringValue(in.Key), alg, resp.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	raw := &s3.GetObjectOutput{
+		AcceptRanges:              resp.AcceptRanges,
+		Body:                      http.NoBody,
+		CacheControl:              resp.CacheControl,
+		ContentDisposition:        resp.ContentDisposition,
+		ContentEncoding:           resp.ContentEncoding,
+		ContentLanguage:           resp.ContentLanguage,
+		ContentLength:             aws.Int64(0),
+		ContentType:               resp.ContentType,
+		DeleteMarker:              resp.DeleteMarker,
+		ETag:                      resp.ETag,
+		Expiration:                resp.Expiration,
+		Expires:                   resp.Expires,
+		LastModified:              resp.LastModified,
+		Metadata:                  resp.Metadata,
+		MissingMeta:               resp.MissingMeta,
+		ObjectLockLegalHoldStatus: resp.ObjectLockLegalHoldStatus,
+		ObjectLockMode:            resp.ObjectLockMode,
+		ObjectLockRetainUntilDate: resp.ObjectLockRetainUntilDate,
+		PartsCount:                resp.PartsCount,
+		ReplicationStatus:         resp.ReplicationStatus,
+		RequestCharged:            resp.RequestCharged,
+		Restore:                   resp.Restore,
+		SSECustomerAlgorithm:      resp.SSECustomerAlgorithm,
+		SSECustomerKeyMD5:         resp.SSECustomerKeyMD5,
+		SSEKMSKeyId:               resp.SSEKMSKeyId,
+		ServerSideEncryption:      resp.ServerSideEncryption,
+		StorageClass:              resp.StorageClass,
+		VersionId:                 resp.VersionId,
+		WebsiteRedirectLocation:   resp.WebsiteRedirectLocation,
+	}
+	return &reader{
+		body: http.NoBody,
+		attrs: driver.ReaderAttributes{
+			ContentType: aws.StringValue(resp.ContentType),
+			ModTime:     aws.TimeValue(resp.LastModified),
+			Size:        size,
+		},
+		raw: raw,
+	}, nil
+}
+
+// parseRestore parses the x-amz-restore header of an object, which is either
+//  ongoing-request="true"
+// while the object is being restored, or
+//  ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+// once it has been. It returns zero values for an empty or malformed header.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectHEAD.html.
+func parseRestore(header string) (ongoing bool, expiry time.Time) {
+	// The expiry date contains a comma, so we can't just split on commas.
+	for _, m := range restoreFieldRE.FindAllStringSubmatch(header, -1) {
+		switch m[1] {
+		case "ongoing-request":
+			ongoing = m[2] == "true"
+		case "expiry-date":
+			expiry, _ = time.Parse(time.RFC1123, m[2])
+		}
+	}
+	return ongoing, expiry
+}
+
+// restoreFieldRE matches a key="value" field of the x-amz-restore header.
+var restoreFieldRE = regexp.MustCompile(`([a-z-]+)="([^"]*)"`)
+
+// etagToMD5 processes an ETag header and returns an MD5 hash if possible.
+// S3's ETag header is sometimes a quoted hexstring of the MD5. Other times,
+// notably when the object was uploaded in multiple parts, it is not.
+// We do the best we can; if decodeMultipart is true, the hash portion of a
+// multi-part ETag is decoded too.
+// Some links about ETag:
+// https://docs.aws.amazon.com/AmazonS3/latest/API/RESTCommonResponseHeaders.html
+// https://github.com/aws/aws-sdk-net/issues/815
+// https://teppen.io/2018/06/23/aws_s3_etags/
+func eTagToMD5(etag *string, decodeMultipart bool) []byte {
+	if etag == nil {
+		// No header at all.
+		return nil
+	}
+	// Strip the expected leading and trailing quotes.
+	quoted := *etag
+	if len(quoted) < 2 || quoted[0] != '"' || quoted[len(quoted)-1] != '"' {
+		return nil
+	}
+	unquoted := quoted[1 : len(quoted)-1]
+	if decodeMultipart {
+		// Multi-part ETags look like "<hex>-<number of parts>".
+		if i := strings.LastIndex(unquoted, "-"); i >= 0 {
+			unquoted = unquoted[:i]
+		}
+	}
+	// Un-hex; we return nil on error. In particular, we'll get an error here
+	// for multi-part uploaded blobs, whose ETag will contain a "-" and so will
+	// never be a legal hex encoding.
+	md5, err := hex.DecodeString(unquoted)
+	if err != nil {
+		return nil
+	}
+	return md5
+}
+
+// IsMultipartETag reports whether etag, such as blob.Attributes.ETag, is
+// the ETag of an object uploaded in multiple parts ("<hex>-<number of
+// parts>"), which is a hash of the parts' hashes rather than of the content.
+// Such objects have a nil MD5, unless Options.DecodeMultipartETags is set.
+func IsMultipartETag(etag string) bool {
+	return strings.Contains(strings.Trim(etag, `"`), "-")
+}
+
+// HasContentMD5 reports whether attrs.MD5, for an object in a bucket opened
+// by this package, is the MD5 of the object's content and can be used for
+// integrity checks. It is false if MD5 is nil, if the object was uploaded in
+// multiple parts (see IsMultipartETag), or if it is encrypted with SSE-KMS
+// or SSE-C, whose ETags are not the MD5 of the content either.
+func HasContentMD5(attrs blob.Attributes) bool {
+	if len(attrs.MD5) == 0 || IsMultipartETag(attrs.ETag) {
+		return false
+	}
+	var head s3.HeadObjectOutput
+	if attrs.As(&head) {
+		if aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms || head.SSECustomerAlgorithm != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ReplicationStatus returns the replication status of the object with attrs,
+// for a bucket opened by this package: "PENDING", "COMPLETED" or "FAILED" for
+// an object in a bucket with replication rules, "REPLICA" for a replica, or
+// empty if the object isn't replicated. See
+// https://docs.aws.amazon.com/AmazonS3/latest/dev/crr-status.html.
+func ReplicationStatus(attrs blob.Attributes) string {
+	var head s3.HeadObjectOutput
+	if !attrs.As(&head) {
+		return ""
+	}
+	return aws.StringValue(head.ReplicationStatus)
+}
+
+// GetExpires returns the Expires header of the object with attrs, for a
+// bucket opened by this package, as set by WriterOptions.Expires. It reports
+// false if the object has no Expires header, or one that is not a valid HTTP
+// date.
+func GetExpires(attrs blob.Attributes) (time.Time, bool) {
+	var head s3.HeadObjectOutput
+	if !attrs.As(&head) || head.Expires == nil {
+		return time.Time{}, false
+	}
+	// The AWS SDK doesn't zero-pad the day when it sets the header, and S3
+	// returns it as it was sent; this layout accepts both forms.
+	t, err := time.Parse("Mon, 2 Jan 2006 15:04:05 GMT", *head.Expires)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// isInvalidRange reports whether err is S3's response to a range that
+// can't be satisfied, such as any range of an empty object.
+func isInvalidRange(err error) bool {
+	e, ok := err.(awserr.Error)
+	return ok && e.Code() == "InvalidRange"
+}
+
+func getSize(resp *s3.GetObjectOutput) int64 {
+	// Default size to ContentLength, but that's incorrect for partial-length reads,
+	// including suffix ranges, where ContentLength refers to the size of the
+	// returned Body, not the entire size of the blob. ContentRange has the full
+	// size, unless it is unknown ("*").
+	size := aws.Int64Value(resp.ContentLength)
+	if cr := aws.StringValue(resp.ContentRange); cr != "" {
+		// Sample: bytes 10-14/27 (where 27 is the full size).
+		parts := strings.Split(cr, "/")
+		if len(parts) == 2 {
+			if i, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+				size = i
+			}
+		}
+	}
+	return size
+}
+
+// NewTypedWriter implements driver.NewTypedWriter.
+func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
+	key = b.normalizeKey(key)
+	uploader := s3manager.NewUploaderWithClient(b.client, func(u *s3manager.Uploader) {
+		if b.opts.MinPartSize > 0 {
+			u.PartSize = b.opts.MinPartSize
+		} else if opts.BufferSize != 0 {
+			u.PartSize = int64(opts.BufferSize)
+		}
+		if b.opts.UploadConcurrency > 0 {
+			u.Concurrency = b.opts.UploadConcurrency
+		}
+		u.LeavePartsOnError = b.opts.LeavePartsOnError
+	})
+	wd := &b.opts.WriteDefaults
+	req := &s3manager.UploadInput{
+		Bucket:      aws.String(b.name),
+		ContentType: aws.String(contentType),
+		Key:         aws.String(b.hashKey(key)),
+		Metadata:    wd.metadata(opts.Metadata),
+	}
+	if opts.CacheControl != "" {
+		req.CacheControl = aws.String(opts.CacheControl)
+	} else if wd.CacheControl != "" {
+		req.CacheControl = aws.String(wd.CacheControl)
+	}
+	if opts.ContentDisposition != "" {
+		req.ContentDisposition = aws.String(opts.ContentDisposition)
+	}
+	if opts.ContentEncoding != "" {
+		req.ContentEncoding = aws.String(opts.ContentEncoding)
+	}
+	if opts.ContentLanguage != "" {
+		req.ContentLanguage = aws.String(opts.ContentLanguage)
+	}
+	if len(opts.ContentMD5) > 0 {
+		req.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(opts.ContentMD5))
+	}
+	if wd.ACL != "" {
+		req.ACL = aws.String(wd.ACL)
+	}
+	if wd.StorageClass != "" {
+		req.StorageClass = aws.String(wd.StorageClass)
+	}
+	if wd.ServerSideEncryption != "" {
+		req.ServerSideEncryption = aws.String(wd.ServerSideEncryption)
+	}
+	if wd.SSEKMSKeyID != "" {
+		req.SSEKMSKeyId = aws.String(wd.SSEKMSKeyID)
+	}
+	var wo writeOptions
+	if opts.BeforeWrite != nil {
+		asFunc := func(i interface{}) bool {
+			switch p := i.(type) {
+			case **s3manager.UploadInput:
+				*p = req
+			case **writeOptions:
+				// Set by NewWriter.
+				*p = &wo
+			default:
+				return false
+			}
+			return true
+		}
+		if err := opts.BeforeWrite(asFunc); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateStorageClass(aws.StringValue(req.StorageClass)); err != nil {
+		return nil, err
+	}
+	if err := validateACL(aws.StringValue(req.ACL)); err != nil {
+		return nil, err
+	}
+	// Fail here rather than in the upload, which reports the SDK's error.
+	md, err := b.encodeMetadata(req.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	req.Metadata = md
+	bufSize := uploader.PartSize
+	if b.opts.MultipartThreshold > bufSize {
+		bufSize = b.opts.MultipartThreshold
+	}
+	contentLength := wo.contentLength
+	if contentLength > bufSize {
+		contentLength = 0
+	}
+	w := &writer{
+		bufSize:  int(bufSize),
+		ctx:      ctx,
+		client:   b.client,
+		uploader: uploader,
+		req:      req,
+		donec:    make(chan struct{}),
+
+		hashMetadata:  b.opts.SHA256Metadata,
+		contentLength: contentLength,
+		key:           key,
+		onUpload:      b.opts.OnUpload,
+	}
+	if b.opts.DetectContentType {
+		if mt, _, err := mime.ParseMediaType(aws.StringValue(req.ContentType)); err == nil && (mt == "application/octet-stream" || mt == "binary/octet-stream") {
+			w.detectContentType = true
+		}
+	}
+	uploader.RequestOptions = append(uploader.RequestOptions, w.initiateOption(b.opts.InitiateMultipartRetries))
+	if b.opts.WriteRetry != nil {
+		uploader.RequestOptions = append(uploader.RequestOptions, b.opts.WriteRetry.requestOption())
+	}
+	if wo.checksum != nil {
+		w.checksum = newChecksumVerifier(checksumAlgorithms[ChecksumSHA256], wo.checksum)
+	} else if wo.checksumAlgorithm != nil {
+		w.checksum = newChecksumVerifier(wo.checksumAlgorithm, nil)
+	} else if b.opts.SHA256Checksums {
+		w.checksum = newChecksumVerifier(checksumAlgorithms[ChecksumSHA256], nil)
+	}
+	if w.checksum != nil {
+		uploader.RequestOptions = append(uploader.RequestOptions, w.checksum.requestOption())
+	}
+	if wo.ifNotExist {
+		uploader.RequestOptions = append(uploader.RequestOptions, ifNotExistOption)
+	}
+	if b.opts.CreateDirMarkers {
+		w.afterUpload = func() error { return b.createDirMarkers(ctx, key) }
+	}
+	return w, nil
+}
+
+// createDirMarkers creates a zero-length object for each "directory" that
+// key, which must already have been normalized, is in, unless it already
+// exists. See Options.CreateDirMarkers.
+func (b *bucket) createDirMarkers(ctx context.Context, key string) error {
+	for i := 0; ; {
+		j := strings.Index(key[i:], "/")
+		if j < 0 {
+			return nil
+		}
+		i += j + 1
+		dir := b.hashKey(key[:i])
+		_, err := b.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(b.name),
+			Key:    aws.String(dir),
+		})
+		if b.ErrorCode(err) == gcerrors.NotFound {
+			_, err = b.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+				Bucket: aws.String(b.name),
+				Key:    aws.String(dir),
+				Body:   bytes.NewReader(nil),
 			})
 		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// maxTags is the maximum number of tags S3 allows on an object.
+const maxTags = 10
+
+// validateTags returns an error if tags can't be set on an S3 object.
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: got %d tags, at most %d are allowed", len(tags), maxTags)
+	}
+	for k, v := range tags {
+		if k == "" || utf8.RuneCountInString(k) > 128 {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: tag key %q must be 1 to 128 characters long", k)
+		}
+		if utf8.RuneCountInString(v) > 256 {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: value for tag %q must be at most 256 characters long", k)
+		}
+	}
+	return nil
+}
+
+// SetTags replaces the tags on the object stored at key in bkt, which must
+// have been opened by this package, without rewriting the object.
+// S3 allows at most 10 tags per object. An empty tags removes all tags.
+// See https://docs.aws.amazon.com/AmazonS3/latest/dev/object-tagging.html.
+func SetTags(ctx context.Context, bkt *blob.Bucket, key string, tags map[string]string) error {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return err
+	}
+	if err := validateTags(tags); err != nil {
+		return err
+	}
+	tagSet := make([]*s3.Tag, 0, len(tags))
+	for k, v := range tags {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	sort.Slice(tagSet, func(i, j int) bool { return *tagSet[i].Key < *tagSet[j].Key })
+	_, err = b.client.PutObjectTaggingWithContext(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(b.name),
+		Key:     aws.String(b.objectKey(key)),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	return b.wrapError(err)
+}
+
+// GetTags returns the tags on the object stored at key in bkt, which must
+// have been opened by this package.
+func GetTags(ctx context.Context, bkt *blob.Bucket, key string) (map[string]string, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return nil, err
+	}
+	return b.getTags(ctx, key, "")
+}
+
+// getTags returns the tags on the given version of the object stored at key,
+// or on its latest version if versionID is empty.
+func (b *bucket) getTags(ctx context.Context, key, versionID string) (map[string]string, error) {
+	in := &s3.GetObjectTaggingInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(b.objectKey(key)),
+	}
+	if versionID != "" {
+		in.VersionId = aws.String(versionID)
+	}
+	resp, err := b.client.GetObjectTaggingWithContext(ctx, in)
+	if err != nil {
+		return nil, b.wrapError(err)
+	}
+	tags := make(map[string]string, len(resp.TagSet))
+	for _, t := range resp.TagSet {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags, nil
+}
+
+// ListOptions sets options for List.
+type ListOptions struct {
+	// StartAfter, if not empty, makes the listing start after this key, in
+	// S3's lexicographic (UTF-8 binary) order, without a page token from an
+	// earlier listing. It doesn't need to be the key of an existing object.
+	// Combined with a Prefix, it can split a scan of a bucket into key
+	// ranges that are listed in parallel, each stopping when it reaches the
+	// start of the next range. It is not supported with
+	// Options.KeyHashPrefixLen, since hashed keys are not in logical order.
+	// With Options.ListVersions, it is sent as the KeyMarker.
+	StartAfter string
+
+	// List is passed to blob.Bucket.List. Its BeforeList, if any, is called
+	// after StartAfter has been set on the *s3.ListObjectsV2Input.
+	List *blob.ListOptions
+}
+
+// List is like blob.Bucket.List for bkt, which must have been opened by this
+// package, with additional S3-specific options. opts may be nil.
+func List(bkt *blob.Bucket, opts *ListOptions) (*blob.ListIterator, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	var lopts blob.ListOptions
+	if opts.List != nil {
+		lopts = *opts.List
+	}
+	if opts.StartAfter != "" {
+		if b.opts.KeyHashPrefixLen > 0 {
+			return nil, gcerr.Newf(gcerr.Unimplemented, nil, "s3blob: ListOptions.StartAfter is not supported with Options.KeyHashPrefixLen")
+		}
+		startAfter := b.normalizeKey(opts.StartAfter)
+		beforeList := lopts.BeforeList
+		lopts.BeforeList = func(asFunc func(interface{}) bool) error {
+			var in *s3.ListObjectsV2Input
+			var vin *s3.ListObjectVersionsInput
+			if asFunc(&in) {
+				// S3 ignores StartAfter once there is a ContinuationToken.
+				in.StartAfter = aws.String(startAfter)
+			} else if asFunc(&vin) && vin.KeyMarker == nil {
+				// Later pages have a KeyMarker from the page token.
+				vin.KeyMarker = aws.String(startAfter)
+			}
+			if beforeList != nil {
+				return beforeList(asFunc)
+			}
+			return nil
+		}
+	}
+	return bkt.List(&lopts), nil
+}
+
+// ReaderOptions sets options for NewRangeReader.
+type ReaderOptions struct {
+	// RequireTags, if not empty, makes NewRangeReader fetch the object's tags
+	// before reading it, and fail unless the object has each tag in
+	// RequireTags with the same value; other tags on the object are ignored.
+	// This costs an extra request per read, and the tags could change
+	// between the check and the read.
+	RequireTags map[string]string
+
+	// VersionID, if not empty, is the version of the object to read in a
+	// bucket with versioning enabled, instead of the latest one. The
+	// version read is available as the VersionId of the s3.GetObjectOutput
+	// exposed by blob.Reader.As. Reading a version that doesn't exist fails
+	// with gcerrors.NotFound.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/dev/RetrievingObjectVersions.html.
+	VersionID string
+
+	// IfMatch, if not empty, makes the read fail unless the object's ETag
+	// (blob.Attributes.ETag, including the quotes) is IfMatch.
+	IfMatch string
+	// IfNoneMatch, if not empty, makes the read fail if the object's ETag
+	// is IfNoneMatch, e.g. to revalidate a cached copy.
+	IfNoneMatch string
+	// IfModifiedSince, if not zero, makes the read fail unless the object
+	// has been modified after it.
+	IfModifiedSince time.Time
+
+	// VerifyChecksum, if true, asks S3 for the object's additional checksum
+	// (see WriterOptions.ChecksumAlgorithm) and verifies the content against
+	// it as it is read: once the end is reached, Read returns an error for
+	// which gcerrors.Code returns gcerrors.Internal instead of io.EOF if the
+	// content doesn't match. Only reads of a whole object (offset 0 and a
+	// negative length) with a checksum of its whole content are verified:
+	// S3 doesn't return checksums for ranges, and the composite checksum of
+	// an object uploaded in multiple parts (see ChecksumOf) can't be
+	// computed from the content alone. Other reads proceed unverified.
+	VerifyChecksum bool
+
+	// Reader is passed to blob.Bucket.NewRangeReader. Its BeforeRead, if
+	// any, is called after the other options have been set on the
+	// s3.GetObjectInput.
+	Reader *blob.ReaderOptions
+}
+
+// NewRangeReader is like blob.Bucket.NewRangeReader for bkt, which must have
+// been opened by this package, with additional S3-specific options. opts may
+// be nil.
+//
+// If the object's tags don't match opts.RequireTags, NewRangeReader returns
+// an error for which gcerrors.Code returns gcerrors.FailedPrecondition,
+// without reading the object. So it does if a condition of opts (IfMatch,
+// IfNoneMatch or IfModifiedSince) isn't met; use IsNotModified to tell
+// whether the object was not read because it didn't change, e.g. to keep
+// using a cached copy.
+func NewRangeReader(ctx context.Context, bkt *blob.Bucket, key string, offset, length int64, opts *ReaderOptions) (*blob.Reader, error) {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &ReaderOptions{}
+	}
+	if len(opts.RequireTags) > 0 {
+		tags, err := b.getTags(ctx, key, opts.VersionID)
+		if err != nil {
+			return nil, b.wrapError(err)
+		}
+		for k, want := range opts.RequireTags {
+			if got, ok := tags[k]; !ok || got != want {
+				return nil, gcerr.Newf(gcerr.FailedPrecondition, nil, "s3blob: object %q does not have required tag %q=%q", key, k, want)
+			}
+		}
+	}
+	ropts := opts.Reader
+	if opts.VersionID != "" || opts.IfMatch != "" || opts.IfNoneMatch != "" || !opts.IfModifiedSince.IsZero() || opts.VerifyChecksum {
+		var o blob.ReaderOptions
+		if ropts != nil {
+			o = *ropts
+		}
+		beforeRead := o.BeforeRead
+		o.BeforeRead = func(asFunc func(interface{}) bool) error {
+			var in *s3.GetObjectInput
+			if asFunc(&in) {
+				if opts.VersionID != "" {
+					in.VersionId = aws.String(opts.VersionID)
+				}
+				if opts.IfMatch != "" {
+					in.IfMatch = aws.String(opts.IfMatch)
+				}
+				if opts.IfNoneMatch != "" {
+					in.IfNoneMatch = aws.String(opts.IfNoneMatch)
+				}
+				if !opts.IfModifiedSince.IsZero() {
+					in.IfModifiedSince = aws.Time(opts.IfModifiedSince)
+				}
+			}
+			var ro *readOptions
+			if asFunc(&ro) {
+				ro.verifyChecksum = opts.VerifyChecksum
+			}
+			if beforeRead != nil {
+				return beforeRead(asFunc)
+			}
+			return nil
+		}
+		ropts = &o
 	}
-	return &page, nil
+	return bkt.NewRangeReader(ctx, key, offset, length, ropts)
 }
 
-// As implements driver.As.
-func (b *bucket) As(i interface{}) bool {
-	p, ok := i.(**s3.S3)
-	if !ok {
-		return false
-	}
-	*p = b.client
-	return true
+// readOptions holds the options of NewRangeReader that have no counterpart
+// in s3.GetObjectInput. NewRangeReader sets them from BeforeRead, whose
+// asFunc also accepts a **readOptions.
+type readOptions struct {
+	// verifyChecksum is ReaderOptions.VerifyChecksum.
+	verifyChecksum bool
 }
 
-// As implements driver.ErrorAs.
-func (b *bucket) ErrorAs(err error, i interface{}) bool {
-	switch v := err.(type) {
-	case awserr.Error:
-		if p, ok := i.(*awserr.Error); ok {
-			*p = v
-			return true
-		}
-	}
-	return false
+// IsNotModified reports whether err, returned by NewRangeReader for bkt,
+// means that the object was not read because of ReaderOptions.IfNoneMatch
+// or IfModifiedSince (a 304 Not Modified response), rather than because of
+// IfMatch or another precondition.
+func IsNotModified(bkt *blob.Bucket, err error) bool {
+	var e awserr.Error
+	return err != nil && bkt.ErrorAs(err, &e) && e.Code() == "NotModified"
 }
 
-// Attributes implements driver.Attributes.
-func (b *bucket) Attributes(ctx context.Context, key string) (driver.Attributes, error) {
-	in := &s3.HeadObjectInput{
-		Bucket: aws.String(b.name),
-		Key:    aws.String(key),
+// AttributesOptions sets options for Attributes.
+type AttributesOptions struct {
+	// VersionID, if not empty, is the version of the object whose attributes
+	// are returned, instead of the latest one; see ReaderOptions.VersionID.
+	VersionID string
+
+	// Checksum, if true, requests the object's additional checksum, which
+	// ChecksumOf then returns. S3 only returns it in checksum mode, which
+	// for objects encrypted with SSE-KMS requires the kms:Decrypt
+	// permission in addition to s3:GetObject.
+	Checksum bool
+}
+
+// headOptions holds the options of Attributes that have no counterpart in
+// s3.HeadObjectInput. The package-level Attributes sets them from
+// BeforeAttributes, whose asFunc also accepts a **headOptions.
+type headOptions struct {
+	// checksum is AttributesOptions.Checksum.
+	checksum bool
+}
+
+// Attributes is like blob.Bucket.Attributes for bkt, which must have been
+// opened by this package, with additional S3-specific options. opts may be
+// nil. The version is available as the VersionId of the s3.HeadObjectOutput
+// exposed by blob.Attributes.As.
+func Attributes(ctx context.Context, bkt *blob.Bucket, key string, opts *AttributesOptions) (blob.Attributes, error) {
+	if _, err := fromBucket(bkt); err != nil {
+		return blob.Attributes{}, err
 	}
-	req, resp := b.client.HeadObjectRequest(in)
-	if err := req.Send(); err != nil {
-		return driver.Attributes{}, err
+	if opts == nil {
+		opts = &AttributesOptions{}
 	}
-	var md map[string]string
-	if len(resp.Metadata) > 0 {
-		md = make(map[string]string, len(resp.Metadata))
-		for k, v := range resp.Metadata {
-			if v != nil {
-				md[k] = aws.StringValue(v)
+	return bkt.AttributesWithOptions(ctx, key, &blob.AttributesOptions{
+		BeforeAttributes: func(asFunc func(interface{}) bool) error {
+			var in *s3.HeadObjectInput
+			if asFunc(&in) && opts.VersionID != "" {
+				in.VersionId = aws.String(opts.VersionID)
 			}
-		}
-	}
-	return driver.Attributes{
-		CacheControl:       aws.StringValue(resp.CacheControl),
-		ContentDisposition: aws.StringValue(resp.ContentDisposition),
-		ContentEncoding:    aws.StringValue(resp.ContentEncoding),
-		ContentLanguage:    aws.StringValue(resp.ContentLanguage),
-		ContentType:        aws.StringValue(resp.ContentType),
-		Metadata:           md,
-		ModTime:            aws.TimeValue(resp.LastModified),
-		Size:               aws.Int64Value(resp.ContentLength),
-		MD5:                eTagToMD5(resp.ETag),
-		AsFunc: func(i interface{}) bool {
-			p, ok := i.(*s3.HeadObjectOutput)
-			if !ok {
-				return false
+			var ho *headOptions
+			if asFunc(&ho) {
+				ho.checksum = opts.Checksum
 			}
-			*p = *resp
-			return true
+			return nil
 		},
-	}, nil
+	})
 }
 
-// NewRangeReader implements driver.NewRangeReader.
-func (b *bucket) NewRangeReader(ctx context.Context, key string, offset, length int64, opts *driver.ReaderOptions) (driver.Reader, error) {
-	in := &s3.GetObjectInput{
-		Bucket: aws.String(b.name),
-		Key:    aws.String(key),
+// WriterOptions sets options for NewWriter.
+type WriterOptions struct {
+	// Tags, if not empty, are set on the object as it is written. S3 allows
+	// at most 10 tags per object; unlike metadata, they can be changed later
+	// without rewriting the object (see SetTags), and can be used in
+	// lifecycle rules and for cost allocation.
+	Tags map[string]string
+
+	// ChecksumSHA256, if not empty, is the SHA-256 of the content to be
+	// written. It is sent to S3, which rejects the upload if it doesn't match
+	// the content, and Close fails with an error for which gcerrors.Code
+	// returns gcerrors.Internal if the checksum S3 returns doesn't match the
+	// one sent, as a defense against intermediaries that alter requests or
+	// responses.
+	//
+	// Multipart uploads use S3's composite checksums: the SHA-256 of each
+	// part is sent and checked, and the checksum S3 returns for the object is
+	// checked against the SHA-256 of the concatenated checksums of the
+	// parts. ChecksumSHA256 itself is then only compared with the content
+	// written, before the upload is completed. A part mismatch aborts the
+	// upload, but a mismatch of the object's checksum is only detected after
+	// the object has been written.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/userguide/checking-object-integrity.html.
+	ChecksumSHA256 []byte
+
+	// ChecksumAlgorithm, if not empty, is the algorithm of an additional
+	// checksum that S3 validates and stores with the object: ChecksumCRC32,
+	// ChecksumCRC32C, ChecksumSHA1 or ChecksumSHA256. The checksum is
+	// computed from the content as it is uploaded, and checked like
+	// ChecksumSHA256 (including for each part of a multipart upload, whose
+	// MD5-based ETag is no use for integrity checks). Use ChecksumOf to read
+	// it back from the object's attributes. It overrides
+	// Options.SHA256Checksums, and can only be combined with ChecksumSHA256
+	// if it is ChecksumSHA256.
+	ChecksumAlgorithm string
+
+	// ACL, if not empty, is the canned ACL of the object, overriding
+	// WriteDefaults.ACL; see there for the allowed values.
+	ACL string
+
+	// IfNotExist, if true, makes the write fail if an object already exists
+	// at the key, with an error for which gcerrors.Code returns
+	// gcerrors.FailedPrecondition, by sending "If-None-Match: *" with the
+	// request that creates the object. Of concurrent writers, at most one
+	// succeeds, so it can be used for idempotent creation and leader
+	// election. For multipart uploads S3 checks the condition when the
+	// upload is completed, after all parts have been uploaded.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/userguide/conditional-requests.html.
+	IfNotExist bool
+
+	// Expires, if not zero, sets the Expires header of the object, the time
+	// after which browsers and CDNs consider a cached copy stale. If the
+	// object also has a Cache-Control header with max-age, that takes
+	// precedence for most caches. Use GetExpires to read it back.
+	Expires time.Time
+
+	// ContentLength, if positive, is the number of bytes that will be
+	// written. It is only honoured if it is at most the part size (or
+	// Options.MultipartThreshold, if larger), in which case the object is
+	// uploaded with a single PutObject request when the writer is closed,
+	// and writing more or fewer than ContentLength bytes fails with an error
+	// for which gcerrors.Code returns gcerrors.InvalidArgument, instead of
+	// uploading a truncated object. Larger values are ignored, and the
+	// object is uploaded as if ContentLength were not set; it never makes
+	// the writer buffer more than it otherwise would.
+	ContentLength int64
+
+	// ObjectLock, if not the zero value, is the Object Lock retention period
+	// and legal hold of the object, which prevent it from being deleted or
+	// overwritten. The bucket must have Object Lock enabled. Use
+	// ObjectLockOf with the object's attributes to read them back.
+	// See https://docs.aws.amazon.com/AmazonS3/latest/dev/object-lock.html.
+	ObjectLock ObjectLock
+
+	// Writer is passed to blob.Bucket.NewWriter. Its BeforeWrite, if any, is
+	// called after the tags, ACL, Expires and ObjectLock have been set on
+	// the s3manager.UploadInput.
+	Writer *blob.WriterOptions
+}
+
+// NewWriter is like blob.Bucket.NewWriter for bkt, which must have been
+// opened by this package, with additional S3-specific options. opts may be
+// nil. Use GetTags to read the tags back.
+func NewWriter(ctx context.Context, bkt *blob.Bucket, key string, opts *WriterOptions) (*blob.Writer, error) {
+	if _, err := fromBucket(bkt); err != nil {
+		return nil, err
 	}
-	if offset > 0 && length < 0 {
-		in.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
-	} else if length == 0 {
-		// AWS doesn't support a zero-length read; we'll read 1 byte and then
-		// ignore it in favor of http.NoBody below.
-		in.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset))
-	} else if length >= 0 {
-		in.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	if opts == nil {
+		opts = &WriterOptions{}
+	}
+	var wopts blob.WriterOptions
+	if opts.Writer != nil {
+		wopts = *opts.Writer
 	}
-	req, resp := b.client.GetObjectRequest(in)
-	if err := req.Send(); err != nil {
+	var tagging string
+	if len(opts.Tags) > 0 {
+		if err := validateTags(opts.Tags); err != nil {
+			return nil, err
+		}
+		tagging = encodeTags(opts.Tags)
+	}
+	if err := validateACL(opts.ACL); err != nil {
 		return nil, err
 	}
-	body := resp.Body
-	if length == 0 {
-		body = http.NoBody
+	if err := opts.ObjectLock.validate(); err != nil {
+		return nil, err
 	}
-	return &reader{
-		body: body,
-		attrs: driver.ReaderAttributes{
-			ContentType: aws.StringValue(resp.ContentType),
-			ModTime:     aws.TimeValue(resp.LastModified),
-			Size:        getSize(resp),
-		},
-		raw: resp,
-	}, nil
+	wo := writeOptions{ifNotExist: opts.IfNotExist}
+	if n := opts.ContentLength; n != 0 {
+		if n < 0 {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: ContentLength must not be negative, got %d", n)
+		}
+		wo.contentLength = n
+	}
+	if sum := opts.ChecksumSHA256; len(sum) > 0 {
+		if len(sum) != sha256.Size {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: ChecksumSHA256 must be %d bytes, got %d", sha256.Size, len(sum))
+		}
+		if opts.ChecksumAlgorithm != "" && opts.ChecksumAlgorithm != ChecksumSHA256 {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: ChecksumSHA256 can't be combined with ChecksumAlgorithm %q", opts.ChecksumAlgorithm)
+		}
+		wo.checksum = sum
+	} else if name := opts.ChecksumAlgorithm; name != "" {
+		alg, ok := checksumAlgorithms[name]
+		if !ok {
+			return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: unsupported ChecksumAlgorithm %q", name)
+		}
+		wo.checksumAlgorithm = alg
+	}
+	acl, expires, lock := opts.ACL, opts.Expires, opts.ObjectLock
+	beforeWrite := wopts.BeforeWrite
+	wopts.BeforeWrite = func(asFunc func(interface{}) bool) error {
+		var in *s3manager.UploadInput
+		if asFunc(&in) {
+			if tagging != "" {
+				in.Tagging = aws.String(tagging)
+			}
+			if acl != "" {
+				in.ACL = aws.String(acl)
+			}
+			if !expires.IsZero() {
+				in.Expires = aws.Time(expires)
+			}
+			lock.apply(in)
+		}
+		var w *writeOptions
+		if asFunc(&w) {
+			*w = wo
+		}
+		if beforeWrite != nil {
+			return beforeWrite(asFunc)
+		}
+		return nil
+	}
+	return bkt.NewWriter(ctx, key, &wopts)
 }
 
-// etagToMD5 processes an ETag header and returns an MD5 hash if possible.
-// S3's ETag header is sometimes a quoted hexstring of the MD5. Other times,
-// notably when the object was uploaded in multiple parts, it is not.
-// We do the best we can.
-// Some links about ETag:
-// https://docs.aws.amazon.com/AmazonS3/latest/API/RESTCommonResponseHeaders.html
-// https://github.com/aws/aws-sdk-net/issues/815
-// https://teppen.io/2018/06/23/aws_s3_etags/
-func eTagToMD5(etag *string) []byte {
-	if etag == nil {
-		// No header at all.
-		return nil
+// writeOptions holds the options of NewWriter that the driver applies to
+// the upload requests rather than to the s3manager.UploadInput. NewWriter
+// sets them from BeforeWrite, whose asFunc also accepts a **writeOptions.
+type writeOptions struct {
+	// checksum is WriterOptions.ChecksumSHA256.
+	checksum []byte
+	// checksumAlgorithm is WriterOptions.ChecksumAlgorithm.
+	checksumAlgorithm *checksumAlgorithm
+	// ifNotExist is WriterOptions.IfNotExist.
+	ifNotExist bool
+	// contentLength is WriterOptions.ContentLength.
+	contentLength int64
+}
+
+// ifNotExistOption is a request option for the uploader of a writer that
+// makes the requests that create an object conditional on it not existing;
+// see WriterOptions.IfNotExist. The version of the AWS SDK used by this
+// package does not model the header.
+func ifNotExistOption(r *request.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "CompleteMultipartUpload":
+		r.Handlers.Build.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set("If-None-Match", "*")
+		})
 	}
-	// Strip the expected leading and trailing quotes.
-	quoted := *etag
-	if quoted[0] != '"' || quoted[len(quoted)-1] != '"' {
-		return nil
+}
+
+// encodeTags returns tags encoded as URL query parameters, as S3 expects in
+// the X-Amz-Tagging header.
+func encodeTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
 	}
-	unquoted := quoted[1 : len(quoted)-1]
-	// Un-hex; we return nil on error. In particular, we'll get an error here
-	// for multi-part uploaded blobs, whose ETag will contain a "-" and so will
-	// never be a legal hex encoding.
-	md5, _ := hex.DecodeString(unquoted)
-	return md5
+	sort.Strings(keys)
+	// QueryEscape encodes spaces as "+"; "%20" is unambiguous.
+	escape := func(s string) string { return strings.Replace(url.QueryEscape(s), "+", "%20", -1) }
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = escape(k) + "=" + escape(tags[k])
+	}
+	return strings.Join(parts, "&")
 }
 
-func getSize(resp *s3.GetObjectOutput) int64 {
-	// Default size to ContentLength, but that's incorrect for partial-length reads,
-	// where ContentLength refers to the size of the returned Body, not the entire
-	// size of the blob. ContentRange has the full size.
-	size := aws.Int64Value(resp.ContentLength)
-	if cr := aws.StringValue(resp.ContentRange); cr != "" {
-		// Sample: bytes 10-14/27 (where 27 is the full size).
-		parts := strings.Split(cr, "/")
-		if len(parts) == 2 {
-			if i, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
-				size = i
-			}
+// CopyOptions sets options for Copy.
+type CopyOptions struct {
+	// MetadataDirective is s3.MetadataDirectiveCopy (the default if empty),
+	// which preserves the source object's content type and metadata, or
+	// s3.MetadataDirectiveReplace, which replaces them with ContentType and
+	// Metadata. With REPLACE, an empty ContentType makes S3 use its default
+	// ("binary/octet-stream") and a nil Metadata clears the metadata; it
+	// does not keep the source's values.
+	MetadataDirective string
+	// ContentType is the content type of the copy. It can only be set with
+	// MetadataDirective REPLACE.
+	ContentType string
+	// Metadata is the user metadata of the copy. It can only be set with
+	// MetadataDirective REPLACE.
+	Metadata map[string]string
+	// SourceBucket, if not empty, is the name of the bucket to copy from,
+	// instead of bkt. Its keys are used as given, without the
+	// transformations of Options.NormalizeKeys and KeyHashPrefixLen.
+	SourceBucket string
+}
+
+// Copy copies the object stored at srcKey in bkt (or opts.SourceBucket),
+// which must have been opened by this package, to dstKey in bkt, without
+// downloading it. The bucket's WriteDefaults are applied to the copy,
+// except for CacheControl and Metadata. opts may be nil.
+//
+// Copy uses a single CopyObject request for objects up to 5 GB, and a
+// multipart copy for larger objects, which doesn't copy the object's tags.
+func Copy(ctx context.Context, bkt *blob.Bucket, dstKey, srcKey string, opts *CopyOptions) error {
+	b, err := fromBucket(bkt)
+	if err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	p := &copyParams{srcBucket: b.name, srcKey: b.objectKey(srcKey)}
+	if opts.SourceBucket != "" {
+		p.srcBucket, p.srcKey = opts.SourceBucket, srcKey
+	}
+	switch opts.MetadataDirective {
+	case "", s3.MetadataDirectiveCopy:
+		if opts.ContentType != "" || opts.Metadata != nil {
+			return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: CopyOptions.ContentType and Metadata require MetadataDirective %s", s3.MetadataDirectiveReplace)
 		}
+	case s3.MetadataDirectiveReplace:
+		p.replace = true
+		p.contentType = opts.ContentType
+		p.metadata = opts.Metadata
+	default:
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: unsupported metadata directive %q; must be %s or %s", opts.MetadataDirective, s3.MetadataDirectiveCopy, s3.MetadataDirectiveReplace)
 	}
-	return size
+	return b.wrapError(b.copy(ctx, b.objectKey(dstKey), p))
 }
 
-// NewTypedWriter implements driver.NewTypedWriter.
-func (b *bucket) NewTypedWriter(ctx context.Context, key string, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
-	uploader := s3manager.NewUploader(b.sess, func(u *s3manager.Uploader) {
-		if opts.BufferSize != 0 {
-			u.PartSize = int64(opts.BufferSize)
-		}
+// Copy implements driver.Copier. Unlike Copy with MetadataDirective REPLACE,
+// it keeps the source object's attributes that opts doesn't override.
+func (b *bucket) Copy(ctx context.Context, dstKey, srcKey string, opts *driver.CopyOptions) error {
+	return b.copy(ctx, b.objectKey(dstKey), &copyParams{
+		srcBucket:   b.name,
+		srcKey:      b.objectKey(srcKey),
+		replace:     opts.ContentType != "" || opts.Metadata != nil,
+		keepUnset:   true,
+		contentType: opts.ContentType,
+		metadata:    opts.Metadata,
+		beforeCopy:  opts.BeforeCopy,
+	})
+}
+
+// copyParams are the parameters of bucket.copy.
+type copyParams struct {
+	srcBucket, srcKey string // srcKey is the object key, after objectKey
+
+	// replace is set for MetadataDirective REPLACE, with contentType and
+	// metadata. If keepUnset is set, an empty contentType, a nil metadata
+	// and the other content headers are taken from the source object;
+	// otherwise they are left unset.
+	replace     bool
+	keepUnset   bool
+	contentType string
+	metadata    map[string]string
+
+	beforeCopy func(asFunc func(interface{}) bool) error
+}
+
+const (
+	// maxCopyObjectSize is the size of the largest object that can be
+	// copied with CopyObject; larger objects need a multipart copy.
+	maxCopyObjectSize = 5 << 30
+	// minCopyPartSize is the minimum size of each part of a multipart copy.
+	minCopyPartSize = 512 << 20
+)
+
+// copy copies an object to dstKey, an object key (after objectKey),
+// as described by p.
+func (b *bucket) copy(ctx context.Context, dstKey string, p *copyParams) error {
+	head, err := b.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(p.srcBucket),
+		Key:    aws.String(p.srcKey),
 	})
-	var metadata map[string]*string
-	if len(opts.Metadata) > 0 {
-		metadata = make(map[string]*string, len(opts.Metadata))
-		for k, v := range opts.Metadata {
-			metadata[k] = aws.String(v)
+	if err != nil {
+		return err
+	}
+	// The content headers of the copy, used if they are replaced, or for a
+	// multipart copy, which doesn't copy them.
+	content := &s3.CreateMultipartUploadInput{}
+	if !p.replace || p.keepUnset {
+		content.CacheControl = head.CacheControl
+		content.ContentDisposition = head.ContentDisposition
+		content.ContentEncoding = head.ContentEncoding
+		content.ContentLanguage = head.ContentLanguage
+		content.ContentType = head.ContentType
+		content.Metadata = head.Metadata
+	}
+	if p.replace {
+		if p.contentType != "" {
+			content.ContentType = aws.String(p.contentType)
+		}
+		if p.metadata != nil {
+			content.Metadata = aws.StringMap(p.metadata)
+		}
+		if content.Metadata, err = b.encodeMetadata(content.Metadata); err != nil {
+			return err
 		}
 	}
-	req := &s3manager.UploadInput{
-		Bucket:      aws.String(b.name),
-		ContentType: aws.String(contentType),
-		Key:         aws.String(key),
-		Metadata:    metadata,
+	wd := &b.opts.WriteDefaults
+	source := copySource(p.srcBucket, p.srcKey)
+
+	size := aws.Int64Value(head.ContentLength)
+	if size <= maxCopyObjectSize {
+		in := &s3.CopyObjectInput{
+			Bucket:     aws.String(b.name),
+			Key:        aws.String(dstKey),
+			CopySource: aws.String(source),
+		}
+		if p.replace {
+			in.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+			in.CacheControl = content.CacheControl
+			in.ContentDisposition = content.ContentDisposition
+			in.ContentEncoding = content.ContentEncoding
+			in.ContentLanguage = content.ContentLanguage
+			in.ContentType = content.ContentType
+			if len(content.Metadata) > 0 {
+				in.Metadata = content.Metadata
+			}
+		}
+		if wd.ACL != "" {
+			in.ACL = aws.String(wd.ACL)
+		}
+		if wd.StorageClass != "" {
+			in.StorageClass = aws.String(wd.StorageClass)
+		}
+		if wd.ServerSideEncryption != "" {
+			in.ServerSideEncryption = aws.String(wd.ServerSideEncryption)
+		}
+		if wd.SSEKMSKeyID != "" {
+			in.SSEKMSKeyId = aws.String(wd.SSEKMSKeyID)
+		}
+		if p.beforeCopy != nil {
+			asFunc := func(i interface{}) bool {
+				if pin, ok := i.(**s3.CopyObjectInput); ok {
+					*pin = in
+					return true
+				}
+				return false
+			}
+			if err := p.beforeCopy(asFunc); err != nil {
+				return err
+			}
+		}
+		if err := validateStorageClass(aws.StringValue(in.StorageClass)); err != nil {
+			return err
+		}
+		if err := validateACL(aws.StringValue(in.ACL)); err != nil {
+			return err
+		}
+		_, err = b.client.CopyObjectWithContext(ctx, in)
+		return err
 	}
-	if opts.CacheControl != "" {
-		req.CacheControl = aws.String(opts.CacheControl)
+
+	in := content
+	in.Bucket = aws.String(b.name)
+	in.Key = aws.String(dstKey)
+	if len(in.Metadata) == 0 {
+		in.Metadata = nil
 	}
-	if opts.ContentDisposition != "" {
-		req.ContentDisposition = aws.String(opts.ContentDisposition)
+	if wd.ACL != "" {
+		in.ACL = aws.String(wd.ACL)
 	}
-	if opts.ContentEncoding != "" {
-		req.ContentEncoding = aws.String(opts.ContentEncoding)
+	if wd.StorageClass != "" {
+		in.StorageClass = aws.String(wd.StorageClass)
 	}
-	if opts.ContentLanguage != "" {
-		req.ContentLanguage = aws.String(opts.ContentLanguage)
+	if wd.ServerSideEncryption != "" {
+		in.ServerSideEncryption = aws.String(wd.ServerSideEncryption)
 	}
-	if len(opts.ContentMD5) > 0 {
-		req.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(opts.ContentMD5))
+	if wd.SSEKMSKeyID != "" {
+		in.SSEKMSKeyId = aws.String(wd.SSEKMSKeyID)
 	}
-	if opts.BeforeWrite != nil {
+	if p.beforeCopy != nil {
 		asFunc := func(i interface{}) bool {
-			p, ok := i.(**s3manager.UploadInput)
-			if !ok {
-				return false
+			if pin, ok := i.(**s3.CreateMultipartUploadInput); ok {
+				*pin = in
+				return true
 			}
-			*p = req
-			return true
+			return false
 		}
-		if err := opts.BeforeWrite(asFunc); err != nil {
-			return nil, err
+		if err := p.beforeCopy(asFunc); err != nil {
+			return err
 		}
 	}
-	return &writer{
-		ctx:      ctx,
-		uploader: uploader,
-		req:      req,
-		donec:    make(chan struct{}),
-	}, nil
+	if err := validateStorageClass(aws.StringValue(in.StorageClass)); err != nil {
+		return err
+	}
+	if err := validateACL(aws.StringValue(in.ACL)); err != nil {
+		return err
+	}
+	return b.multipartCopy(ctx, in, source, size)
+}
+
+// multipartCopy copies size bytes from source into a new multipart upload
+// created with in, in parts of at least minCopyPartSize.
+func (b *bucket) multipartCopy(ctx context.Context, in *s3.CreateMultipartUploadInput, source string, size int64) error {
+	partSize := int64(minCopyPartSize)
+	if n := (size + s3manager.MaxUploadParts - 1) / s3manager.MaxUploadParts; n > partSize {
+		partSize = n
+	}
+	resp, err := b.client.CreateMultipartUploadWithContext(ctx, in)
+	if err != nil {
+		return err
+	}
+	uploadID := resp.UploadId
+	var parts []*s3.CompletedPart
+	for offset, num := int64(0), int64(1); offset < size; offset, num = offset+partSize, num+1 {
+		end := offset + partSize
+		if end > size {
+			end = size
+		}
+		resp, err := b.client.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          in.Bucket,
+			Key:             in.Key,
+			UploadId:        uploadID,
+			PartNumber:      aws.Int64(num),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+		})
+		if err != nil {
+			b.abortMultipartCopy(in, uploadID)
+			return err
+		}
+		var etag *string
+		if resp.CopyPartResult != nil {
+			etag = resp.CopyPartResult.ETag
+		}
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(num), ETag: etag})
+	}
+	_, err = b.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          in.Bucket,
+		Key:             in.Key,
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		b.abortMultipartCopy(in, uploadID)
+	}
+	return err
+}
+
+// abortMultipartCopy aborts a failed multipart copy, so that its parts don't
+// linger. It uses a fresh context, since the copy's may have been canceled.
+func (b *bucket) abortMultipartCopy(in *s3.CreateMultipartUploadInput, uploadID *string) {
+	_, _ = b.client.AbortMultipartUploadWithContext(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   in.Bucket,
+		Key:      in.Key,
+		UploadId: uploadID,
+	})
+}
+
+// copySource returns the value of the x-amz-copy-source header for key in
+// bucket, which must be URL-encoded.
+func copySource(bucket, key string) string {
+	parts := strings.Split(bucket+"/"+key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
 }
 
 // Delete implements driver.Delete.
+//
+// S3's DeleteObject succeeds whether or not the object exists, so Delete
+// first checks that it does with a HeadObject request, and the result of
+// that check determines the result of Delete:
+//  - If the object doesn't exist, Delete returns a NotFound error without
+//    sending DeleteObject, even if the object is created concurrently
+//    before Delete returns; that object is not deleted.
+//  - If the object exists, Delete sends DeleteObject and returns nil unless
+//    that request fails, even if the object was deleted concurrently in
+//    between; the object no longer exists either way.
+// In both cases the outcome is as if Delete had run entirely at the time of
+// the check. With Options.SkipDeleteExistenceCheck there is no check, and
+// deleting a missing object succeeds.
 func (b *bucket) Delete(ctx context.Context, key string) error {
-	if _, err := b.Attributes(ctx, key); err != nil {
-		return err
+	if !b.opts.SkipDeleteExistenceCheck {
+		if _, err := b.Attributes(ctx, key); err != nil {
+			return err
+		}
 	}
 	input := &s3.DeleteObjectInput{
 		Bucket: aws.String(b.name),
-		Key:    aws.String(key),
+		Key:    aws.String(b.objectKey(key)),
+	}
+	_, err := b.client.DeleteObjectWithContext(ctx, input)
+	return err
+}
+
+// maxDeleteObjects is the maximum number of keys in a DeleteObjects request.
+const maxDeleteObjects = 1000
+
+// DeleteAll implements driver.BatchDeleter, using a DeleteObjects request for
+// each batch of up to 1000 keys. If a request fails entirely, the error is
+// reported for each of its keys, and the remaining batches are still sent.
+func (b *bucket) DeleteAll(ctx context.Context, keys []string) map[string]error {
+	var errs map[string]error
+	fail := func(key string, err error) {
+		if errs == nil {
+			errs = map[string]error{}
+		}
+		errs[key] = err
+	}
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > maxDeleteObjects {
+			batch = batch[:maxDeleteObjects]
+		}
+		keys = keys[len(batch):]
+
+		// S3 reports errors by object key; map them back to the caller's keys.
+		logical := make(map[string]string, len(batch))
+		objs := make([]*s3.ObjectIdentifier, 0, len(batch))
+		for _, key := range batch {
+			k := b.objectKey(key)
+			if _, dup := logical[k]; dup {
+				continue
+			}
+			logical[k] = key
+			objs = append(objs, &s3.ObjectIdentifier{Key: aws.String(k)})
+		}
+		resp, err := b.client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(b.name),
+			Delete: &s3.Delete{Objects: objs, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			for _, key := range logical {
+				fail(key, err)
+			}
+			continue
+		}
+		for _, e := range resp.Errors {
+			key, ok := logical[aws.StringValue(e.Key)]
+			if !ok {
+				key = aws.StringValue(e.Key)
+			}
+			fail(key, awserr.New(aws.StringValue(e.Code), aws.StringValue(e.Message), nil))
+		}
+	}
+	return errs
+}
+
+// DefaultSignedURLExpiry implements driver.SignedURLExpiryDefaulter.
+func (b *bucket) DefaultSignedURLExpiry() time.Duration {
+	if b.opts.SignedURLExpiry > 0 {
+		return b.opts.SignedURLExpiry
+	}
+	if b.opts.MaxSignedURLExpiry < blob.DefaultSignedURLExpiry {
+		return b.opts.MaxSignedURLExpiry
 	}
-	req, _ := b.client.DeleteObjectRequest(input)
-	return req.Send()
+	return blob.DefaultSignedURLExpiry
 }
 
 func (b *bucket) SignedURL(ctx context.Context, key string, opts *driver.SignedURLOptions) (string, error) {
-	in := &s3.GetObjectInput{
-		Bucket: aws.String(b.name),
-		Key:    aws.String(key),
+	// URLs signed for longer than S3 allows would only fail when used.
+	if opts.Expiry > b.opts.MaxSignedURLExpiry {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "s3blob: SignedURLOptions.Expiry %v exceeds the maximum of %v", opts.Expiry, b.opts.MaxSignedURLExpiry)
+	}
+	var req *request.Request
+	switch opts.Method {
+	case http.MethodPut:
+		in := &s3.PutObjectInput{
+			Bucket: aws.String(b.name),
+			Key:    aws.String(b.objectKey(key)),
+		}
+		if opts.ContentType != "" {
+			// Content-Type is a signed header, so the upload must send it.
+			in.ContentType = aws.String(opts.ContentType)
+		}
+		req, _ = b.client.PutObjectRequest(in)
+	case http.MethodGet:
+		in := &s3.GetObjectInput{
+			Bucket: aws.String(b.name),
+			Key:    aws.String(b.objectKey(key)),
+		}
+		// The overrides are sent as signed query parameters.
+		if opts.ResponseContentType != "" {
+			in.ResponseContentType = aws.String(opts.ResponseContentType)
+		}
+		if opts.ResponseContentDisposition != "" {
+			in.ResponseContentDisposition = aws.String(opts.ResponseContentDisposition)
+		}
+		req, _ = b.client.GetObjectRequest(in)
+	case http.MethodHead:
+		req, _ = b.client.HeadObjectRequest(&s3.HeadObjectInput{
+			Bucket: aws.String(b.name),
+			Key:    aws.String(b.objectKey(key)),
+		})
+	case http.MethodDelete:
+		req, _ = b.client.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket: aws.String(b.name),
+			Key:    aws.String(b.objectKey(key)),
+		})
+	default:
+		return "", gcerr.Newf(gcerr.Unimplemented, nil, "s3blob: unsupported SignedURL method %q", opts.Method)
 	}
-	req, _ := b.client.GetObjectRequest(in)
+	// Presigning doesn't send the request, but handlers may still use ctx.
+	req.SetContext(ctx)
 	return req.Presign(opts.Expiry)
 }
@@ -0,0 +1,64 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build s3compat
+
+package s3blob
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// TestS3CompatDisableContentMD5Validation runs against a real S3-compatible
+// backend that rejects the checksum headers added by the AWS SDK, given by
+// the S3COMPAT_ENDPOINT, S3COMPAT_REGION and S3COMPAT_BUCKET environment
+// variables; credentials come from the usual AWS environment variables.
+// Run it with:
+//  go test -tags s3compat -run TestS3Compat ./blob/s3blob
+func TestS3CompatDisableContentMD5Validation(t *testing.T) {
+	endpoint, bucket := os.Getenv("S3COMPAT_ENDPOINT"), os.Getenv("S3COMPAT_BUCKET")
+	if endpoint == "" || bucket == "" {
+		t.Skip("S3COMPAT_ENDPOINT and S3COMPAT_BUCKET must be set")
+	}
+	ctx := context.Background()
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(endpoint),
+		Region:           aws.String(os.Getenv("S3COMPAT_REGION")),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := OpenBucket(ctx, sess, bucket, &Options{DisableContentMD5Validation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "s3compat-test"
+	if err := b.WriteAll(ctx, key, []byte("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete(ctx, key)
+	got, err := b.ReadAll(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q want %q", got, "hello")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3blob
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// webIdentityProviderName is the ProviderName of credentials from
+// webIdentityProvider.
+const webIdentityProviderName = "s3blob.WebIdentityProvider"
+
+// webIdentityExpiryWindow is how long before they expire credentials from
+// webIdentityProvider are refreshed, so that requests signed just before
+// the expiry don't fail.
+const webIdentityExpiryWindow = 5 * time.Minute
+
+// webIdentityProvider is a credentials.Provider that gets temporary
+// credentials for a role from STS AssumeRoleWithWebIdentity, with an OIDC
+// token read from a file, such as the service account token that EKS
+// mounts into pods for IAM roles for service accounts; see
+// Options.WebIdentityTokenFile. The version of the AWS SDK used by this
+// package has no such provider.
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client      *sts.STS
+	roleARN     string
+	tokenFile   string
+	sessionName string
+}
+
+func newWebIdentityCredentials(sess client.ConfigProvider, roleARN, tokenFile, sessionName string) *credentials.Credentials {
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("gocloud-s3blob-%d", time.Now().UnixNano())
+	}
+	return credentials.NewCredentials(&webIdentityProvider{
+		client:      sts.New(sess),
+		roleARN:     roleARN,
+		tokenFile:   tokenFile,
+		sessionName: sessionName,
+	})
+}
+
+// Retrieve implements credentials.Provider.
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	// The token is read each time, since it is rotated while the
+	// credentials are in use.
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{ProviderName: webIdentityProviderName}, fmt.Errorf("s3blob: reading web identity token: %v", err)
+	}
+	// The request is unsigned, so it doesn't need credentials itself.
+	resp, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.sessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	})
+	if err != nil {
+		return credentials.Value{ProviderName: webIdentityProviderName}, err
+	}
+	p.SetExpiration(aws.TimeValue(resp.Credentials.Expiration), webIdentityExpiryWindow)
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(resp.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(resp.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(resp.Credentials.SessionToken),
+		ProviderName:    webIdentityProviderName,
+	}, nil
+}
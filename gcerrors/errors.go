@@ -51,6 +51,20 @@ const (
 
 	// The system was in the wrong state.
 	FailedPrecondition ErrorCode = gcerr.FailedPrecondition
+
+	// The caller does not have permission to execute the specified operation.
+	PermissionDenied ErrorCode = gcerr.PermissionDenied
+
+	// The service is temporarily unable to handle the request; retrying it
+	// may succeed.
+	Unavailable ErrorCode = gcerr.Unavailable
+
+	// Some resource has been exhausted, typically because a service resource
+	// is at its limit, or to throttle the caller.
+	ResourceExhausted ErrorCode = gcerr.ResourceExhausted
+
+	// The operation was canceled, typically by the caller.
+	Canceled ErrorCode = gcerr.Canceled
 )
 
 // Code returns the ErrorCode of err if it is an *Error.
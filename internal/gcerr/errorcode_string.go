@@ -4,9 +4,9 @@ package gcerr
 
 import "strconv"
 
-const _ErrorCode_name = "OKUnknownNotFoundAlreadyExistsInvalidArgumentInternal"
+const _ErrorCode_name = "OKUnknownNotFoundAlreadyExistsInvalidArgumentInternalUnimplementedFailedPreconditionPermissionDeniedUnavailableResourceExhaustedCanceled"
 
-var _ErrorCode_index = [...]uint8{0, 2, 9, 17, 30, 45, 53}
+var _ErrorCode_index = [...]uint8{0, 2, 9, 17, 30, 45, 53, 66, 84, 100, 111, 128, 136}
 
 func (i ErrorCode) String() string {
 	if i < 0 || i >= ErrorCode(len(_ErrorCode_index)-1) {
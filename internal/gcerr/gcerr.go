@@ -53,6 +53,20 @@ const (
 
 	// The system was in the wrong state.
 	FailedPrecondition ErrorCode = 7
+
+	// The caller does not have permission to execute the specified operation.
+	PermissionDenied ErrorCode = 8
+
+	// The service is temporarily unable to handle the request; retrying it
+	// may succeed.
+	Unavailable ErrorCode = 9
+
+	// Some resource has been exhausted, typically because a service resource
+	// is at its limit, or to throttle the caller.
+	ResourceExhausted ErrorCode = 10
+
+	// The operation was canceled, typically by the caller.
+	Canceled ErrorCode = 11
 )
 
 // TODO(jba) call stringer after it's fixed for modules
@@ -126,6 +140,14 @@ func GRPCCode(err error) ErrorCode {
 		return Internal
 	case codes.Unimplemented:
 		return Unimplemented
+	case codes.PermissionDenied:
+		return PermissionDenied
+	case codes.Unavailable:
+		return Unavailable
+	case codes.ResourceExhausted:
+		return ResourceExhausted
+	case codes.Canceled:
+		return Canceled
 	default:
 		return Unknown
 	}